@@ -0,0 +1,53 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/donamKim/ftp-server-go/otp"
+)
+
+// enroll generates a TOTP secret for a user and prints the otp_secret to put
+// in server.yaml together with the otpauth URI for authenticator apps.
+func enroll(args []string) {
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	issuer := fs.String("issuer", "FTP Server Go", "issuer shown in the authenticator app")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %v enroll [-issuer name] <user>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	secret, err := otp.NewSecret()
+	if err != nil {
+		log.Fatalf("failed to generate the secret: %v", err)
+	}
+	fmt.Printf("otp_secret: %v\n", secret)
+	fmt.Printf("uri: %v\n", otp.URI(*issuer, fs.Arg(0), secret))
+}
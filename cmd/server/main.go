@@ -21,6 +21,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
@@ -29,6 +34,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/checksum"
+	"github.com/donamKim/ftp-server-go/file/privsep"
+	"github.com/donamKim/ftp-server-go/file/quota"
+	"github.com/donamKim/ftp-server-go/otp"
 	"github.com/donamKim/ftp-server-go/pi"
 
 	"github.com/spf13/cast"
@@ -40,10 +50,47 @@ func init() {
 	rand.Seed(time.Now().Unix())
 }
 
+type userConfig struct {
+	Name               string
+	Password           string
+	Access             accessConfig
+	Certificates       []string
+	RequireCertificate bool          `mapstructure:"require_certificate"`
+	TLSPolicy          *policyConfig `mapstructure:"tls_policy"`
+	OTPSecret          string        `mapstructure:"otp_secret"`
+	SystemUser         string        `mapstructure:"system_user"`
+	Storage            string
+	Root               string
+	Quota              *quotaConfig
+	Trash              bool
+	TrashRetention     time.Duration `mapstructure:"trash_retention"`
+	Versions           int
+	VersionsMaxAge     time.Duration `mapstructure:"versions_max_age"`
+}
+
+type accessConfig struct {
+	Allow []string
+	Deny  []string
+}
+
+type policyConfig struct {
+	RequireLogin bool `mapstructure:"require_login"`
+	RequireData  bool `mapstructure:"require_data"`
+	Exempt       []string
+}
+
 func main() {
+	if privsep.Init() == true {
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "enroll" {
+		enroll(os.Args[2:])
+		return
+	}
+
 	initConfig()
-	initServer()
-	waitSignal()
+	svr, storages, trees := initServer()
+	waitSignal(svr, storages, trees)
 }
 
 func initConfig() {
@@ -54,23 +101,226 @@ func initConfig() {
 	}
 }
 
-func initServer() {
-	svr := pi.Server{
-		User: struct {
-			Name     string
-			Password string
-		}{
-			Name:     viper.GetString("user.name"),
-			Password: viper.GetString("user.password"),
-		},
+func initServer() (*pi.Server, map[string]file.ManagerV2, quotaTrees) {
+	loader := newQuotaLoader(nil)
+	users, access, policy, err := loadAccounts(loader)
+	if err != nil {
+		log.Fatalf("failed to load the accounts: %v", err)
+	}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		log.Fatalf("failed to load the TLS config: %v", err)
+	}
+	storages, err := loadStorages()
+	if err != nil {
+		log.Fatalf("failed to load the storages: %v", err)
+	}
+	if err := checkStorages(storages, users); err != nil {
+		log.Fatalf("failed to load the accounts: %v", err)
+	}
+	quotas, err := loadQuotas(loader)
+	if err != nil {
+		log.Fatalf("failed to load the quotas: %v", err)
+	}
+	var checksums *checksum.Cache
+	if dir := viper.GetString("checksum_cache"); len(dir) > 0 {
+		if checksums, err = checksum.New(dir); err != nil {
+			log.Fatalf("failed to open the checksum cache: %v", err)
+		}
+	}
+
+	svr := &pi.Server{
+		Users:       users,
+		Access:      access,
 		Root:        viper.GetString("root"),
 		PIPort:      viper.GetInt("pi_port"),
 		PassivePort: cast.ToIntSlice(viper.Get("passive_port")),
+		TLSConfig:   tlsConfig,
+		TLSPolicy:   policy,
+		Quotas:      quotas,
+		Checksums:   checksums,
+		NewManager:  newManagerFunc(storages),
+	}
+	l, err := svr.Listen()
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	if name := viper.GetString("run_as"); len(name) > 0 {
+		// The spawner keeps the privilege to start the helpers of the
+		// system users.
+		if os.Geteuid() == 0 {
+			if svr.Spawner, err = privsep.NewSpawner(); err != nil {
+				log.Fatalf("failed to start the privsep spawner: %v", err)
+			}
+		}
+		if err := dropPrivileges(name); err != nil {
+			log.Fatalf("failed to drop privileges: %v", err)
+		}
+	}
+	go func() {
+		log.Fatalf("failed to serve: %v", svr.Serve(l))
+	}()
+
+	return svr, storages, loader.trees
+}
+
+func loadAccounts(loader *quotaLoader) ([]pi.User, *pi.Access, *pi.TLSPolicy, error) {
+	list := make([]userConfig, 0)
+	if err := viper.UnmarshalKey("users", &list); err != nil {
+		return nil, nil, nil, err
+	}
+	if viper.IsSet("user.name") == true {
+		list = append(list, userConfig{Name: viper.GetString("user.name"), Password: viper.GetString("user.password")})
+	}
+
+	users := make([]pi.User, 0, len(list))
+	for _, v := range list {
+		access, err := pi.NewAccess(v.Access.Allow, v.Access.Deny)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid access rule: user=%v, err=%v", v.Name, err)
+		}
+		policy, err := newTLSPolicy(v.TLSPolicy)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid TLS policy: user=%v, err=%v", v.Name, err)
+		}
+		if len(v.OTPSecret) > 0 {
+			if err := otp.CheckSecret(v.OTPSecret); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid otp_secret: user=%v, err=%v", v.Name, err)
+			}
+		}
+		var credential *syscall.Credential
+		if len(v.SystemUser) > 0 {
+			if credential, err = lookupCredential(v.SystemUser); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid system user: user=%v, err=%v", v.Name, err)
+			}
+			if credential.Uid == 0 {
+				return nil, nil, nil, fmt.Errorf("system user must not be root: user=%v", v.Name)
+			}
+		} else if keepsRoot() == true {
+			return nil, nil, nil, fmt.Errorf("system_user is required without run_as as root: user=%v", v.Name)
+		}
+		var tree *quota.Tree
+		if v.Quota != nil {
+			root := v.Root
+			if len(root) == 0 {
+				root = viper.GetString("root")
+			}
+			if len(root) == 0 {
+				return nil, nil, nil, fmt.Errorf("quota needs a root: user=%v", v.Name)
+			}
+			tree = loader.tree("user:"+v.Name, root, v.Quota)
+		}
+		users = append(users, pi.User{
+			Name:               v.Name,
+			Password:           v.Password,
+			Access:             access,
+			Certificates:       v.Certificates,
+			RequireCertificate: v.RequireCertificate,
+			TLSPolicy:          policy,
+			OTPSecret:          v.OTPSecret,
+			Credential:         credential,
+			Storage:            v.Storage,
+			Root:               v.Root,
+			Quota:              tree,
+			Trash:              v.Trash,
+			TrashRetention:     v.TrashRetention,
+			Versions:           v.Versions,
+			VersionsMaxAge:     v.VersionsMaxAge,
+		})
+	}
+
+	access, err := pi.NewAccess(viper.GetStringSlice("access.allow"), viper.GetStringSlice("access.deny"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid access rule: %v", err)
+	}
+
+	config := new(policyConfig)
+	if err := viper.UnmarshalKey("tls_policy", config); err != nil {
+		return nil, nil, nil, err
+	}
+	policy, err := newTLSPolicy(config)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid TLS policy: %v", err)
+	}
+
+	return users, access, policy, nil
+}
+
+// keepsRoot reports whether the server keeps running as root, where the
+// sessions of the accounts without a system user would run as root.
+func keepsRoot() bool {
+	return os.Geteuid() == 0 && len(viper.GetString("run_as")) == 0
+}
+
+func newTLSPolicy(config *policyConfig) (*pi.TLSPolicy, error) {
+	if config == nil {
+		return nil, nil
+	}
+	exempt, err := pi.ParseNetworks(config.Exempt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pi.TLSPolicy{RequireLogin: config.RequireLogin, RequireData: config.RequireData, Exempt: exempt}, nil
+}
+
+func loadTLSConfig() (*tls.Config, error) {
+	certFile := viper.GetString("tls.cert_file")
+	if len(certFile) == 0 {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, viper.GetString("tls.key_file"))
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile := viper.GetString("tls.client_ca_file"); len(caFile) > 0 {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(pem) == false {
+			return nil, errors.New("no certificate found in the client CA file")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// reloadConfig returns the quota trees of the reloaded config, or the
+// previous ones when it failed.
+func reloadConfig(svr *pi.Server, storages map[string]file.ManagerV2, trees quotaTrees) quotaTrees {
+	if err := viper.ReadInConfig(); err != nil {
+		log.Printf("failed to reload the config file: %v", err)
+		return trees
 	}
-	svr.ListenAndServe()
+	loader := newQuotaLoader(trees)
+	users, access, policy, err := loadAccounts(loader)
+	if err != nil {
+		log.Printf("failed to reload the accounts: %v", err)
+		return trees
+	}
+	if err := checkStorages(storages, users); err != nil {
+		log.Printf("failed to reload the accounts: %v", err)
+		return trees
+	}
+	quotas, err := loadQuotas(loader)
+	if err != nil {
+		log.Printf("failed to reload the quotas: %v", err)
+		return trees
+	}
+	svr.Reload(users, access, policy, quotas)
+	log.Printf("reloaded the config file")
+
+	return loader.trees
 }
 
-func waitSignal() {
+func waitSignal(svr *pi.Server, storages map[string]file.ManagerV2, trees quotaTrees) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGPIPE)
 
@@ -80,8 +330,10 @@ func waitSignal() {
 		case syscall.SIGTERM, syscall.SIGINT:
 			log.Fatalf("caught %v signal: shutting down...", s)
 			return
+		case syscall.SIGHUP:
+			trees = reloadConfig(svr, storages, trees)
 		default:
-			log.Fatalf("caught %v signal: ignored!", s)
+			log.Printf("caught %v signal: ignored!", s)
 		}
 	}
 }
@@ -0,0 +1,80 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/donamKim/ftp-server-go/file/quota"
+
+	"github.com/spf13/viper"
+)
+
+type quotaConfig struct {
+	Path  string
+	Bytes int64
+	Files int64
+}
+
+// quotaTrees maps the configured trees by the user or the path.
+type quotaTrees map[string]*quota.Tree
+
+// quotaLoader creates the trees of a load. The trees of the previous load
+// whose path and limit are unchanged are kept, so their usage is not scanned
+// again, and the others are dropped with the previous load.
+type quotaLoader struct {
+	previous quotaTrees
+	trees    quotaTrees
+}
+
+func newQuotaLoader(previous quotaTrees) *quotaLoader {
+	return &quotaLoader{previous: previous, trees: make(quotaTrees)}
+}
+
+func (r *quotaLoader) tree(key string, path string, config *quotaConfig) *quota.Tree {
+	limit := quota.Limit{Bytes: config.Bytes, Files: config.Files}
+	v, ok := r.previous[key]
+	if ok == false || v.Path != filepath.Clean(path) || v.Limit() != limit {
+		v = quota.NewTree(path, limit)
+	}
+	r.trees[key] = v
+
+	return v
+}
+
+func loadQuotas(loader *quotaLoader) ([]*quota.Tree, error) {
+	list := make([]quotaConfig, 0)
+	if err := viper.UnmarshalKey("quota", &list); err != nil {
+		return nil, err
+	}
+
+	trees := make([]*quota.Tree, 0, len(list))
+	for _, v := range list {
+		if len(v.Path) == 0 {
+			return nil, errors.New("empty quota path")
+		}
+		config := v
+		trees = append(trees, loader.tree("path:"+v.Path, v.Path, &config))
+	}
+
+	return trees, nil
+}
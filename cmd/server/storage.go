@@ -0,0 +1,241 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/archive"
+	"github.com/donamKim/ftp-server-go/file/crypt"
+	"github.com/donamKim/ftp-server-go/file/dedup"
+	"github.com/donamKim/ftp-server-go/file/driver"
+	"github.com/donamKim/ftp-server-go/file/filter"
+	"github.com/donamKim/ftp-server-go/file/memory"
+	"github.com/donamKim/ftp-server-go/file/mount"
+	"github.com/donamKim/ftp-server-go/file/readonly"
+	"github.com/donamKim/ftp-server-go/file/s3"
+	"github.com/donamKim/ftp-server-go/pi"
+
+	"github.com/spf13/viper"
+)
+
+const defaultStorage = "default"
+
+type storageConfig struct {
+	Type      string
+	Path      string
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	Prefix    string
+	PartSize  int `mapstructure:"part_size"`
+	Atomic    bool
+	ReadOnly  bool `mapstructure:"read_only"`
+	Hide      []string
+	Keyfile   string
+	Archives  bool
+
+	Mounts     []mountConfig
+	CopyRename bool `mapstructure:"copy_rename"`
+}
+
+type mountConfig struct {
+	Path    string
+	Storage string
+	Target  string
+}
+
+// loadStorages creates the named backends of the storage section. A "local"
+// backend without options maps to nil, which leaves the session on the local
+// file system.
+func loadStorages() (map[string]file.ManagerV2, error) {
+	configs := make(map[string]storageConfig)
+	if err := viper.UnmarshalKey("storage", &configs); err != nil {
+		return nil, err
+	}
+
+	storages := map[string]file.ManagerV2{defaultStorage: nil}
+	for name, v := range configs {
+		if v.Type == "mount" {
+			continue
+		}
+
+		switch v.Type {
+		case "", "local":
+			storages[name] = nil
+			if v.Atomic == true {
+				storages[name] = &driver.Driver{Atomic: true}
+			}
+		case "memory":
+			storages[name] = memory.New()
+		case "dedup":
+			if len(v.Path) == 0 {
+				return nil, fmt.Errorf("empty path of dedup storage: name=%v", name)
+			}
+			store, err := dedup.New(v.Path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open dedup storage: name=%v, err=%v", name, err)
+			}
+			storages[name] = store
+		case "s3":
+			storages[name] = &s3.Bucket{
+				Endpoint:  v.Endpoint,
+				Region:    v.Region,
+				Name:      v.Bucket,
+				AccessKey: v.AccessKey,
+				SecretKey: v.SecretKey,
+				Prefix:    v.Prefix,
+				PartSize:  v.PartSize,
+			}
+		default:
+			return nil, fmt.Errorf("unknown storage type: name=%v, type=%v", name, v.Type)
+		}
+
+		manager, err := decorate(storages[name], v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage: name=%v, err=%v", name, err)
+		}
+		storages[name] = manager
+	}
+
+	// Mount tables are built last from the other storages, which keeps them
+	// from mounting each other.
+	for name, v := range configs {
+		if v.Type != "mount" {
+			continue
+		}
+
+		table, err := newMountTable(storages, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage: name=%v, err=%v", name, err)
+		}
+		manager, err := decorate(table, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage: name=%v, err=%v", name, err)
+		}
+		storages[name] = manager
+	}
+
+	return storages, nil
+}
+
+func newMountTable(storages map[string]file.ManagerV2, config storageConfig) (*mount.Table, error) {
+	table := mount.New()
+	table.CopyRename = config.CopyRename
+	for _, v := range config.Mounts {
+		name := strings.ToLower(v.Storage)
+		if len(name) == 0 {
+			name = defaultStorage
+		}
+		manager, ok := storages[name]
+		if ok == false {
+			return nil, fmt.Errorf("unknown storage to mount: path=%v, storage=%v", v.Path, v.Storage)
+		}
+		if manager == nil {
+			manager = &driver.Driver{}
+		}
+		if len(v.Path) == 0 {
+			return nil, errors.New("empty mount path")
+		}
+
+		target := v.Target
+		if len(target) == 0 {
+			target = v.Path
+		}
+		table.Mount(v.Path, manager, target)
+	}
+
+	return table, nil
+}
+
+// decorate wraps the backend with the encryption, archive, filter and
+// read-only options.
+func decorate(manager file.ManagerV2, config storageConfig) (file.ManagerV2, error) {
+	if len(config.Keyfile) == 0 && config.Archives == false && len(config.Hide) == 0 && config.ReadOnly == false {
+		return manager, nil
+	}
+	if manager == nil {
+		manager = &driver.Driver{Atomic: config.Atomic}
+	}
+
+	if len(config.Keyfile) > 0 {
+		keys, err := crypt.NewKeyring(config.Keyfile)
+		if err != nil {
+			return nil, err
+		}
+		manager = crypt.New(manager, keys)
+	}
+	if config.Archives == true {
+		manager = archive.New(manager)
+	}
+	if len(config.Hide) > 0 {
+		m, err := filter.New(manager, config.Hide)
+		if err != nil {
+			return nil, err
+		}
+		manager = m
+	}
+	if config.ReadOnly == true {
+		manager = readonly.New(manager)
+	}
+
+	return manager, nil
+}
+
+func checkStorages(storages map[string]file.ManagerV2, users []pi.User) error {
+	for _, v := range users {
+		manager, ok := storages[storageName(&v)]
+		if ok == false {
+			return fmt.Errorf("unknown storage: user=%v, storage=%v", v.Name, v.Storage)
+		}
+		// privsep serves only the local file system without decorators.
+		if _, local := manager.(*driver.Driver); v.Credential != nil && manager != nil && local == false {
+			return fmt.Errorf("system_user needs a plain local storage: user=%v, storage=%v", v.Name, v.Storage)
+		}
+	}
+
+	return nil
+}
+
+func storageName(user *pi.User) string {
+	if len(user.Storage) == 0 {
+		return defaultStorage
+	}
+
+	// viper lower cases the keys of the storage section.
+	return strings.ToLower(user.Storage)
+}
+
+func newManagerFunc(storages map[string]file.ManagerV2) func(user *pi.User) (file.ManagerV2, error) {
+	return func(user *pi.User) (file.ManagerV2, error) {
+		manager, ok := storages[storageName(user)]
+		if ok == false {
+			return nil, fmt.Errorf("unknown storage: %v", user.Storage)
+		}
+
+		return manager, nil
+	}
+}
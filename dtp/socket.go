@@ -21,6 +21,7 @@
 package dtp
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"os"
@@ -33,7 +34,7 @@ import (
 
 type Socket struct {
 	Port int
-	Conn *net.TCPConn
+	Conn net.Conn
 
 	mutex    sync.Mutex
 	errAsync error
@@ -89,9 +90,12 @@ func (r *Socket) listenAndServe(port int) error {
 	r.mutex.Lock()
 	go func() {
 		defer r.mutex.Unlock()
-		if r.Conn, r.errAsync = l.AcceptTCP(); r.errAsync != nil {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			r.errAsync = err
 			return
 		}
+		r.Conn = conn
 		r.errAsync = l.Close()
 	}()
 
@@ -121,6 +125,28 @@ func isEADDRINUSE(err error) bool {
 	return false
 }
 
+// Secure wraps the established data connection with TLS as the server side
+// of the handshake, which RFC 4217 requires in both active and passive mode.
+func (r *Socket) Secure(config *tls.Config) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.errAsync != nil {
+		return r.errAsync
+	}
+	if r.Conn == nil {
+		return errors.New("nil conn")
+	}
+
+	conn := tls.Server(r.Conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	r.Conn = conn
+
+	return nil
+}
+
 func (r *Socket) Read(p []byte) (n int, err error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -0,0 +1,140 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package file
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Adapt wraps a Manager as a ManagerV2. Readers from Get are closed when
+// they implement io.Closer, and Put is fed through a pipe.
+func Adapt(manager Manager) ManagerV2 {
+	return &adapter{manager: manager}
+}
+
+type adapter struct {
+	manager Manager
+}
+
+func (r *adapter) Stat(ctx context.Context, path string) (*Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.manager.Stat(path)
+}
+
+func (r *adapter) List(ctx context.Context, path string) ([]*Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.manager.List(path)
+}
+
+func (r *adapter) Get(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	reader, err := r.manager.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := reader.(io.ReadCloser); ok == true {
+		return v, nil
+	}
+
+	return ioutil.NopCloser(reader), nil
+}
+
+func (r *adapter) Put(ctx context.Context, path string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewPipeWriter(func(reader io.Reader) error {
+		return r.manager.Put(path, reader)
+	}), nil
+}
+
+func (r *adapter) Remove(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.manager.Remove(path)
+}
+
+func (r *adapter) Rename(ctx context.Context, old string, new string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.manager.Rename(old, new)
+}
+
+var errAborted = errors.New("file: write aborted")
+
+// NewPipeWriter runs fn in a goroutine reading everything written to the
+// returned writer. Close waits for fn and returns its error, while Abort
+// makes the reader of fn fail before waiting.
+func NewPipeWriter(fn func(reader io.Reader) error) io.WriteCloser {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := fn(reader)
+		if err != nil {
+			reader.CloseWithError(err)
+		} else {
+			reader.CloseWithError(io.ErrClosedPipe)
+		}
+		done <- err
+	}()
+
+	return &pipeWriter{PipeWriter: writer, done: done}
+}
+
+type pipeWriter struct {
+	*io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (r *pipeWriter) wait() error {
+	r.once.Do(func() {
+		r.err = <-r.done
+	})
+	return r.err
+}
+
+func (r *pipeWriter) Close() error {
+	r.PipeWriter.Close()
+	return r.wait()
+}
+
+func (r *pipeWriter) Abort() error {
+	r.PipeWriter.CloseWithError(errAborted)
+	r.wait()
+
+	return nil
+}
@@ -0,0 +1,546 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package archive serves the entries of ZIP and TAR archives as read-only
+// directories below the archive, as in "/data/set.zip/docs/readme.txt".
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// cacheSize is the number of archive indexes kept, which saves reading an
+// archive again while a client browses it.
+const cacheSize = 16
+
+var extensions = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// Manager reports the archives as directories, while Get still reads the
+// archive itself. Nested archives are served as plain files.
+type Manager struct {
+	file.Decorator
+
+	mutex   sync.Mutex
+	indexes map[string]*index
+	order   []string
+}
+
+func New(manager file.ManagerV2) *Manager {
+	return &Manager{Decorator: file.Decorator{ManagerV2: manager}, indexes: make(map[string]*index)}
+}
+
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, v := range extensions {
+		if strings.HasSuffix(name, v) == true && len(name) > len(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func isZip(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".zip")
+}
+
+func isGzip(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// split finds the archive holding p, and returns it with the path of the
+// entry in it, which is "/" for the archive itself.
+func (r *Manager) split(ctx context.Context, p string) (string, string, *file.Info, bool) {
+	p = filepath.Clean(p)
+	for i := 1; i <= len(p); i++ {
+		if i < len(p) && p[i] != filepath.Separator {
+			continue
+		}
+		archive := p[:i]
+		if isArchive(filepath.Base(archive)) == false {
+			continue
+		}
+		info, err := r.ManagerV2.Stat(ctx, archive)
+		if err != nil || info.Mode().IsRegular() == false {
+			continue
+		}
+
+		return archive, "/" + strings.TrimPrefix(p[i:], "/"), info, true
+	}
+
+	return p, "", nil, false
+}
+
+func denied(op string, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+}
+
+// directory is the info of an archive served as a directory, searchable by
+// those who can read the archive.
+func directory(info *file.Info) *file.Info {
+	attr := info.Attr()
+	read := attr.Mode.Perm() & 0444
+	attr.Mode = os.ModeDir | read | read>>2
+
+	return attr.Info()
+}
+
+func (r *Manager) Stat(ctx context.Context, p string) (*file.Info, error) {
+	archive, name, info, ok := r.split(ctx, p)
+	if ok == false {
+		return r.ManagerV2.Stat(ctx, p)
+	}
+	if name == "/" {
+		return directory(info), nil
+	}
+
+	idx, err := r.load(ctx, archive, info)
+	if err != nil {
+		return nil, err
+	}
+	e, ok := idx.entries[name]
+	if ok == false {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+
+	return e.info(info), nil
+}
+
+func (r *Manager) List(ctx context.Context, p string) ([]*file.Info, error) {
+	archive, name, info, ok := r.split(ctx, p)
+	if ok == false {
+		list, err := r.ManagerV2.List(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range list {
+			if v.Mode().IsRegular() == true && isArchive(v.Name()) == true {
+				list[i] = directory(v)
+			}
+		}
+		return list, nil
+	}
+
+	idx, err := r.load(ctx, archive, info)
+	if err != nil {
+		return nil, err
+	}
+	e, ok := idx.entries[name]
+	if ok == false {
+		return nil, &os.PathError{Op: "list", Path: p, Err: os.ErrNotExist}
+	}
+	if e.mode.IsDir() == false {
+		return []*file.Info{e.info(info)}, nil
+	}
+
+	list := make([]*file.Info, 0, len(e.children))
+	for _, v := range e.children {
+		list = append(list, idx.entries[v].info(info))
+	}
+
+	return list, nil
+}
+
+func (r *Manager) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	archive, name, info, ok := r.split(ctx, p)
+	if ok == false || name == "/" {
+		return r.ManagerV2.Get(ctx, p)
+	}
+
+	idx, err := r.load(ctx, archive, info)
+	if err != nil {
+		return nil, err
+	}
+	e, ok := idx.entries[name]
+	if ok == false {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	if e.mode.IsDir() == true {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrInvalid}
+	}
+
+	if isZip(archive) == true {
+		return r.openZip(ctx, archive, info, e.key)
+	}
+	return r.openTar(ctx, archive, e.key)
+}
+
+// GetAt skips the first offset bytes of an entry, which has to be
+// decompressed from its start anyway.
+func (r *Manager) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	if _, name, _, ok := r.split(ctx, p); ok == false || name == "/" {
+		return file.GetAt(ctx, r.ManagerV2, p, offset)
+	}
+
+	reader, err := r.Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Writes to an archive itself are passed through, for uploads replacing or
+// resuming it. The index is loaded again when its size or time changed.
+func (r *Manager) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	if _, name, _, ok := r.split(ctx, p); ok == true && name != "/" {
+		return nil, denied("create", p)
+	}
+	return r.ManagerV2.Put(ctx, p)
+}
+
+func (r *Manager) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	if _, name, _, ok := r.split(ctx, p); ok == true && name != "/" {
+		return nil, denied("create", p)
+	}
+	return file.PutAt(ctx, r.ManagerV2, p, offset)
+}
+
+func (r *Manager) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	if _, name, _, ok := r.split(ctx, p); ok == true && name != "/" {
+		return nil, denied("append", p)
+	}
+	return file.Append(ctx, r.ManagerV2, p)
+}
+
+// Remove and Rename of an archive itself change the archive file.
+func (r *Manager) Remove(ctx context.Context, p string) error {
+	if _, name, _, ok := r.split(ctx, p); ok == true && name != "/" {
+		return denied("remove", p)
+	}
+	return r.ManagerV2.Remove(ctx, p)
+}
+
+func (r *Manager) Rename(ctx context.Context, old string, new string) error {
+	for _, v := range []string{old, new} {
+		if _, name, _, ok := r.split(ctx, v); ok == true && name != "/" {
+			return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrPermission}
+		}
+	}
+	return r.ManagerV2.Rename(ctx, old, new)
+}
+
+func (r *Manager) Mkdir(ctx context.Context, p string) error {
+	if _, _, _, ok := r.split(ctx, p); ok == true {
+		return denied("mkdir", p)
+	}
+	return file.Mkdir(ctx, r.ManagerV2, p)
+}
+
+func (r *Manager) Symlink(ctx context.Context, target string, p string) error {
+	if _, _, _, ok := r.split(ctx, p); ok == true {
+		return denied("symlink", p)
+	}
+	return file.Symlink(ctx, r.ManagerV2, target, p)
+}
+
+func (r *Manager) Chmod(ctx context.Context, p string, mode os.FileMode) error {
+	if _, name, _, ok := r.split(ctx, p); ok == true && name != "/" {
+		return denied("chmod", p)
+	}
+	return file.Chmod(ctx, r.ManagerV2, p, mode)
+}
+
+func (r *Manager) Chtimes(ctx context.Context, p string, modTime time.Time) error {
+	if _, name, _, ok := r.split(ctx, p); ok == true && name != "/" {
+		return denied("chtimes", p)
+	}
+	return file.Chtimes(ctx, r.ManagerV2, p, modTime)
+}
+
+type index struct {
+	size    int64
+	modTime time.Time
+	entries map[string]*entry
+}
+
+type entry struct {
+	key      string
+	size     int64
+	mode     os.FileMode
+	modTime  time.Time
+	children []string
+}
+
+// info takes the owner from the archive, and drops the write permissions.
+func (r *entry) info(archive *file.Info) *file.Info {
+	return file.Attr{
+		Name:    path.Base(r.key),
+		Size:    r.size,
+		Mode:    r.mode &^ 0222,
+		ModTime: r.modTime,
+		Uid:     archive.Uid,
+		Gid:     archive.Gid,
+	}.Info()
+}
+
+func newIndex(info *file.Info) *index {
+	root := &entry{key: "/", mode: os.ModeDir | 0555, modTime: info.ModTime()}
+	return &index{size: info.Size(), modTime: info.ModTime(), entries: map[string]*entry{"/": root}}
+}
+
+// add stores an entry of the archive, creating the parents it lacks.
+func (r *index) add(name string, size int64, mode os.FileMode, modTime time.Time) {
+	key := path.Clean("/" + name)
+	if key == "/" {
+		return
+	}
+	if e, ok := r.entries[key]; ok == true {
+		// A directory listed after its files replaces the parent made up
+		// for them.
+		e.size, e.mode, e.modTime = size, mode, modTime
+		return
+	}
+
+	parent := path.Dir(key)
+	if _, ok := r.entries[parent]; ok == false {
+		r.add(parent, 0, os.ModeDir|0555, modTime)
+	}
+	r.entries[key] = &entry{key: key, size: size, mode: mode, modTime: modTime}
+	p := r.entries[parent]
+	p.children = append(p.children, key)
+}
+
+func (r *index) sort() {
+	for _, v := range r.entries {
+		sort.Strings(v.children)
+	}
+}
+
+// load returns the index of the archive, read again when the archive
+// changed.
+func (r *Manager) load(ctx context.Context, archive string, info *file.Info) (*index, error) {
+	r.mutex.Lock()
+	idx, ok := r.indexes[archive]
+	r.mutex.Unlock()
+	if ok == true && idx.size == info.Size() && idx.modTime.Equal(info.ModTime()) == true {
+		return idx, nil
+	}
+
+	var err error
+	if isZip(archive) == true {
+		idx, err = r.scanZip(ctx, archive, info)
+	} else {
+		idx, err = r.scanTar(ctx, archive, info)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: archive, Err: err}
+	}
+	idx.sort()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.indexes[archive]; ok == false {
+		r.order = append(r.order, archive)
+	}
+	r.indexes[archive] = idx
+	if len(r.order) > cacheSize {
+		delete(r.indexes, r.order[0])
+		r.order = r.order[1:]
+	}
+
+	return idx, nil
+}
+
+func (r *Manager) scanZip(ctx context.Context, archive string, info *file.Info) (*index, error) {
+	reader, closer, err := r.readerAt(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	z, err := zip.NewReader(reader, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	idx := newIndex(info)
+	for _, v := range z.File {
+		mode := v.Mode()
+		if mode.IsDir() == false && mode.IsRegular() == false {
+			continue
+		}
+		idx.add(v.Name, int64(v.UncompressedSize64), mode, v.Modified)
+	}
+
+	return idx, nil
+}
+
+func (r *Manager) scanTar(ctx context.Context, archive string, info *file.Info) (*index, error) {
+	t, closer, err := r.tarReader(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	idx := newIndex(info)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		mode := hdr.FileInfo().Mode()
+		if mode.IsDir() == false && mode.IsRegular() == false {
+			continue
+		}
+		idx.add(hdr.Name, hdr.Size, mode, hdr.ModTime)
+	}
+
+	return idx, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+func (r *Manager) openZip(ctx context.Context, archive string, info *file.Info, key string) (io.ReadCloser, error) {
+	reader, closer, err := r.readerAt(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+	z, err := zip.NewReader(reader, info.Size())
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	for _, v := range z.File {
+		if path.Clean("/"+v.Name) != key {
+			continue
+		}
+		f, err := v.Open()
+		if err != nil {
+			closer.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: f, close: func() error {
+			f.Close()
+			return closer.Close()
+		}}, nil
+	}
+	closer.Close()
+
+	return nil, &os.PathError{Op: "open", Path: archive + key, Err: os.ErrNotExist}
+}
+
+func (r *Manager) openTar(ctx context.Context, archive string, key string) (io.ReadCloser, error) {
+	t, closer, err := r.tarReader(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		hdr, err := t.Next()
+		if err != nil {
+			closer.Close()
+			if err == io.EOF {
+				err = &os.PathError{Op: "open", Path: archive + key, Err: os.ErrNotExist}
+			}
+			return nil, err
+		}
+		if hdr.FileInfo().Mode().IsRegular() == true && path.Clean("/"+hdr.Name) == key {
+			return &readCloser{Reader: t, close: closer.Close}, nil
+		}
+	}
+}
+
+func (r *Manager) tarReader(ctx context.Context, archive string) (*tar.Reader, io.Closer, error) {
+	reader, err := r.ManagerV2.Get(ctx, archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isGzip(archive) == false {
+		return tar.NewReader(reader), reader, nil
+	}
+
+	z, err := gzip.NewReader(reader)
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	return tar.NewReader(z), &readCloser{close: func() error {
+		z.Close()
+		return reader.Close()
+	}}, nil
+}
+
+// readerAt reads the archive in place when the manager returns a file, and
+// with a request per read otherwise.
+func (r *Manager) readerAt(ctx context.Context, archive string) (io.ReaderAt, io.Closer, error) {
+	reader, err := r.ManagerV2.Get(ctx, archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v, ok := reader.(io.ReaderAt); ok == true {
+		return v, reader, nil
+	}
+	reader.Close()
+
+	return &rangeReader{ctx: ctx, manager: r.ManagerV2, path: archive}, &readCloser{close: func() error { return nil }}, nil
+}
+
+type rangeReader struct {
+	ctx     context.Context
+	manager file.ManagerV2
+	path    string
+}
+
+func (r *rangeReader) ReadAt(p []byte, offset int64) (int, error) {
+	reader, err := file.GetAt(r.ctx, r.manager, r.path, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	n, err := io.ReadFull(reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
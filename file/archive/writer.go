@@ -0,0 +1,187 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// TrimExtension returns the directory named by an archive name like
+// "dir.tar.gz", and whether Write supports its extension.
+func TrimExtension(p string) (string, bool) {
+	name := strings.ToLower(p)
+	for _, v := range extensions {
+		if strings.HasSuffix(name, v) == true && len(name) > len(v) {
+			return p[:len(p)-len(v)], true
+		}
+	}
+	return p, false
+}
+
+type builder interface {
+	add(name string, info *file.Info, reader io.Reader) error
+	Close() error
+}
+
+// Write streams an archive of the tree of dir to w while walking it, in the
+// format of the extension of name. The entries are below the base name of
+// dir, and anything but files and directories is left out.
+func Write(ctx context.Context, m file.ManagerV2, dir string, name string, w io.Writer) error {
+	var b builder
+	switch {
+	case isZip(name) == true:
+		b = &zipBuilder{writer: zip.NewWriter(w)}
+	case isGzip(name) == true:
+		z := gzip.NewWriter(w)
+		b = &tarBuilder{writer: tar.NewWriter(z), closer: z}
+	default:
+		b = &tarBuilder{writer: tar.NewWriter(w)}
+	}
+
+	if err := walk(ctx, m, dir, filepath.Base(dir), b); err != nil {
+		b.Close()
+		return err
+	}
+	return b.Close()
+}
+
+func walk(ctx context.Context, m file.ManagerV2, dir string, name string, b builder) error {
+	info, err := m.Stat(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if err := b.add(name, info, nil); err != nil {
+		return err
+	}
+
+	list, err := m.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p := filepath.Join(dir, v.Name())
+		switch {
+		case v.IsDir() == true:
+			err = walk(ctx, m, p, path.Join(name, v.Name()), b)
+		case v.Mode().IsRegular() == true:
+			err = addFile(ctx, m, p, path.Join(name, v.Name()), v, b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addFile(ctx context.Context, m file.ManagerV2, p string, name string, info *file.Info, b builder) error {
+	reader, err := m.Get(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return b.add(name, info, reader)
+}
+
+type tarBuilder struct {
+	writer *tar.Writer
+	closer io.Closer
+}
+
+// add writes the size of the listing, and fails when the file changed size
+// since.
+func (r *tarBuilder) add(name string, info *file.Info, reader io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+		Uid:     int(info.Uid),
+		Gid:     int(info.Gid),
+	}
+	if reader == nil {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	} else {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	}
+	if err := r.writer.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if reader == nil {
+		return nil
+	}
+
+	_, err := io.CopyN(r.writer, reader, hdr.Size)
+	return err
+}
+
+func (r *tarBuilder) Close() error {
+	err := r.writer.Close()
+	if r.closer != nil {
+		if errClose := r.closer.Close(); err == nil {
+			err = errClose
+		}
+	}
+
+	return err
+}
+
+type zipBuilder struct {
+	writer *zip.Writer
+}
+
+func (r *zipBuilder) add(name string, info *file.Info, reader io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()}
+	if reader == nil {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+		hdr.SetMode(info.Mode())
+	} else {
+		hdr.SetMode(info.Mode().Perm())
+	}
+
+	w, err := r.writer.CreateHeader(hdr)
+	if err != nil || reader == nil {
+		return err
+	}
+	_, err = io.Copy(w, reader)
+
+	return err
+}
+
+func (r *zipBuilder) Close() error {
+	return r.writer.Close()
+}
@@ -0,0 +1,191 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package checksum keeps the checksums of files in sidecar files, so they are
+// computed once per content of a file.
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// Cache stores an entry per path of a namespace, like the storage of a user,
+// below Dir. An entry is valid while the size and the modification time of
+// the file match it.
+//
+// A modification time of whole seconds may come from a backend keeping no
+// finer one, where a change of the same size within that second goes
+// unnoticed. Such an entry is trusted only when it was stored at least a
+// second after the modification time, so the first lookup after an upload to
+// these backends computes the checksum again.
+type Cache struct {
+	Dir string
+
+	mutex sync.Mutex
+}
+
+type entry struct {
+	Path    string            `json:"path"`
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"mod_time"`
+	Stored  time.Time         `json:"stored"`
+	Sums    map[string]string `json:"sums"`
+}
+
+func New(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Cache{Dir: filepath.Clean(dir)}, nil
+}
+
+// sidecar names the entry by a digest of the key, which keeps the paths of
+// the files from clashing with each other.
+func (r *Cache) sidecar(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+
+	return filepath.Join(r.Dir, name[:2], name)
+}
+
+func cacheKey(namespace string, p string) string {
+	return namespace + "\x00" + filepath.Clean(p)
+}
+
+func (r *Cache) read(key string, info *file.Info) (*entry, bool) {
+	b, err := ioutil.ReadFile(r.sidecar(key))
+	if err != nil {
+		return nil, false
+	}
+	e := new(entry)
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, false
+	}
+	if e.Path != key || e.Size != info.Size() || e.ModTime.Equal(info.ModTime()) == false {
+		return nil, false
+	}
+	if e.ModTime.Nanosecond() == 0 && e.Stored.Sub(e.ModTime) < time.Second {
+		return nil, false
+	}
+
+	return e, true
+}
+
+// Lookup returns the checksum of the file described by info.
+func (r *Cache) Lookup(namespace string, p string, info *file.Info, algorithm string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, ok := r.read(cacheKey(namespace, p), info)
+	if ok == false {
+		return "", false
+	}
+	sum, ok := e.Sums[algorithm]
+
+	return sum, ok
+}
+
+// Store adds the checksums to the entry of the file, which is replaced when
+// it described another content.
+func (r *Cache) Store(namespace string, p string, info *file.Info, sums map[string]string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := cacheKey(namespace, p)
+	e, ok := r.read(key, info)
+	if ok == false {
+		e = &entry{Path: key, Size: info.Size(), ModTime: info.ModTime(), Stored: time.Now(), Sums: make(map[string]string)}
+	}
+	for k, v := range sums {
+		e.Sums[k] = v
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	sidecar := r.sidecar(key)
+	if err := os.MkdirAll(filepath.Dir(sidecar), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(sidecar), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), sidecar)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Invalidate drops the entry of the path, for changes keeping the size and
+// the modification time like a rename over it.
+func (r *Cache) Invalidate(namespace string, p string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	os.Remove(r.sidecar(cacheKey(namespace, p)))
+}
+
+// InvalidateDir drops the entries of every file below the directory, for a
+// directory removed or renamed.
+func (r *Cache) InvalidateDir(namespace string, dir string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	prefix := cacheKey(namespace, dir)
+	if strings.HasSuffix(prefix, "/") == false {
+		prefix += "/"
+	}
+	filepath.Walk(r.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode().IsRegular() == false {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		e := new(entry)
+		if err := json.Unmarshal(b, e); err == nil && strings.HasPrefix(e.Path, prefix) == true {
+			os.Remove(p)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package checksum
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+func newCache(t *testing.T) *Cache {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newInfo(size int64, modTime time.Time) *file.Info {
+	return file.Attr{Name: "a", Size: size, Mode: 0644, ModTime: modTime}.Info()
+}
+
+func TestLookup(t *testing.T) {
+	c := newCache(t)
+	info := newInfo(4, time.Now().Add(-time.Minute))
+	if err := c.Store("user", "/a", info, map[string]string{"SHA-256": "sum"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := c.Lookup("user", "/a", info, "SHA-256"); ok == false || v != "sum" {
+		t.Fatalf("unexpected checksum: %q, %v", v, ok)
+	}
+	if _, ok := c.Lookup("user", "/a", info, "MD5"); ok == true {
+		t.Fatal("unexpected checksum of another algorithm")
+	}
+	if _, ok := c.Lookup("other", "/a", info, "SHA-256"); ok == true {
+		t.Fatal("unexpected checksum of another namespace")
+	}
+	if _, ok := c.Lookup("user", "/a", newInfo(5, info.ModTime()), "SHA-256"); ok == true {
+		t.Fatal("unexpected checksum of another size")
+	}
+	if _, ok := c.Lookup("user", "/a", newInfo(4, time.Now()), "SHA-256"); ok == true {
+		t.Fatal("unexpected checksum of another modification time")
+	}
+}
+
+func TestWholeSeconds(t *testing.T) {
+	c := newCache(t)
+	now := time.Now()
+
+	// A change within the same second would keep the modification time.
+	recent := newInfo(4, now.Truncate(time.Second))
+	if err := c.Store("user", "/recent", recent, map[string]string{"SHA-256": "sum"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Lookup("user", "/recent", recent, "SHA-256"); ok == true {
+		t.Fatal("unexpected checksum stored within the modification second")
+	}
+
+	old := newInfo(4, now.Add(-time.Minute).Truncate(time.Second))
+	if err := c.Store("user", "/old", old, map[string]string{"SHA-256": "sum"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Lookup("user", "/old", old, "SHA-256"); ok == false {
+		t.Fatal("missing checksum stored after the modification second")
+	}
+
+	fine := newInfo(4, now.Truncate(time.Second).Add(time.Millisecond))
+	if err := c.Store("user", "/fine", fine, map[string]string{"SHA-256": "sum"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Lookup("user", "/fine", fine, "SHA-256"); ok == false {
+		t.Fatal("missing checksum of a finer modification time")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c := newCache(t)
+	info := newInfo(4, time.Now().Add(-time.Minute))
+	for _, v := range []string{"/a", "/dir/a", "/dir/sub/a", "/dirty/a"} {
+		if err := c.Store("user", v, info, map[string]string{"SHA-256": "sum"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Store("other", "/dir/a", info, map[string]string{"SHA-256": "sum"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Invalidate("user", "/a")
+	c.InvalidateDir("user", "/dir")
+
+	for _, v := range []struct {
+		namespace string
+		path      string
+		cached    bool
+	}{
+		{"user", "/a", false},
+		{"user", "/dir/a", false},
+		{"user", "/dir/sub/a", false},
+		{"user", "/dirty/a", true},
+		{"other", "/dir/a", true},
+	} {
+		if _, ok := c.Lookup(v.namespace, v.path, info, "SHA-256"); ok != v.cached {
+			t.Fatalf("unexpected entry: namespace=%v, path=%v, cached=%v", v.namespace, v.path, ok)
+		}
+	}
+
+	c.InvalidateDir("user", "/")
+	if _, ok := c.Lookup("user", "/dirty/a", info, "SHA-256"); ok == true {
+		t.Fatal("unexpected entry below the root")
+	}
+}
@@ -0,0 +1,462 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package crypt encrypts the contents of files with AES-GCM before they reach
+// the wrapped manager.
+//
+// A file starts with a header of the magic, the id of its key and a random
+// file id, followed by chunks of ChunkSize plain bytes. Every chunk is sealed
+// with its own random nonce, and authenticates the file id, its index and
+// whether it is the last chunk, so chunks can be neither moved nor dropped.
+// The last chunk may be empty and is always present.
+package crypt
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+const (
+	ChunkSize = 64 << 10
+
+	magic      = "FGC1"
+	idSize     = 16
+	headerSize = len(magic) + 4 + idSize
+	nonceSize  = 12
+	overhead   = nonceSize + 16
+	sealedSize = ChunkSize + overhead
+)
+
+var ErrInvalid = errors.New("invalid encrypted file")
+
+// Manager reports the plain sizes of the files, and serves resumed downloads
+// and uploads by reading and rewriting from the chunk holding the offset. The
+// wrapped storage should hold only files written through it.
+type Manager struct {
+	file.Decorator
+	Keys *Keyring
+}
+
+func New(manager file.ManagerV2, keys *Keyring) *Manager {
+	return &Manager{Decorator: file.Decorator{ManagerV2: manager}, Keys: keys}
+}
+
+// plainSize computes the plain size of an encrypted file of the size.
+func plainSize(size int64) int64 {
+	n := size - int64(headerSize)
+	if n < overhead {
+		return 0
+	}
+	chunks := (n + sealedSize - 1) / sealedSize
+
+	return n - chunks*overhead
+}
+
+// position returns the chunk holding the offset and the plain bytes before
+// the offset in it. An offset at the end of a full chunk stays in that chunk,
+// which may be the last one.
+func position(offset int64) (int64, int64) {
+	index, skip := offset/ChunkSize, offset%ChunkSize
+	if skip == 0 && index > 0 {
+		index, skip = index-1, ChunkSize
+	}
+
+	return index, skip
+}
+
+func plain(info *file.Info) *file.Info {
+	if info.Mode().IsRegular() == false {
+		return info
+	}
+	attr := info.Attr()
+	attr.Size = plainSize(attr.Size)
+
+	return attr.Info()
+}
+
+func (r *Manager) Stat(ctx context.Context, p string) (*file.Info, error) {
+	info, err := r.ManagerV2.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return plain(info), nil
+}
+
+func (r *Manager) List(ctx context.Context, p string) ([]*file.Info, error) {
+	list, err := r.ManagerV2.List(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range list {
+		list[i] = plain(v)
+	}
+
+	return list, nil
+}
+
+type header struct {
+	keyID uint32
+	key   cipher.AEAD
+	id    [idSize]byte
+}
+
+func (r *header) encode() []byte {
+	b := make([]byte, headerSize)
+	copy(b, magic)
+	binary.BigEndian.PutUint32(b[len(magic):], r.keyID)
+	copy(b[len(magic)+4:], r.id[:])
+
+	return b
+}
+
+func (r *header) data(index int64, final bool) []byte {
+	b := make([]byte, idSize+9)
+	copy(b, r.id[:])
+	binary.BigEndian.PutUint64(b[idSize:], uint64(index))
+	if final == true {
+		b[idSize+8] = 1
+	}
+
+	return b
+}
+
+// seal appends the nonce and the sealed chunk to dst.
+func (r *header) seal(dst []byte, chunk []byte, index int64, final bool) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+
+	return r.key.Seal(dst, nonce, chunk, r.data(index, final)), nil
+}
+
+func (r *header) open(dst []byte, sealed []byte, index int64, final bool) ([]byte, error) {
+	if len(sealed) < overhead {
+		return nil, ErrInvalid
+	}
+	v, err := r.key.Open(dst, sealed[:nonceSize], sealed[nonceSize:], r.data(index, final))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	return v, nil
+}
+
+func (r *Manager) newHeader() (*header, error) {
+	keyID, key, err := r.Keys.latest()
+	if err != nil {
+		return nil, err
+	}
+	h := &header{keyID: keyID, key: key}
+	if _, err := io.ReadFull(rand.Reader, h.id[:]); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (r *Manager) readHeader(reader io.Reader) (*header, error) {
+	b := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalid
+		}
+		return nil, err
+	}
+	if string(b[:len(magic)]) != magic {
+		return nil, ErrInvalid
+	}
+
+	h := &header{keyID: binary.BigEndian.Uint32(b[len(magic):])}
+	copy(h.id[:], b[len(magic)+4:])
+	key, err := r.Keys.key(h.keyID)
+	if err != nil {
+		return nil, err
+	}
+	h.key = key
+
+	return h, nil
+}
+
+func (r *Manager) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	return r.GetAt(ctx, p, 0)
+}
+
+func (r *Manager) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	return r.open(ctx, p, offset)
+}
+
+func (r *Manager) open(ctx context.Context, p string, offset int64) (*reader, error) {
+	if offset < 0 {
+		return nil, &os.PathError{Op: "seek", Path: p, Err: syscall.EINVAL}
+	}
+
+	source, err := r.ManagerV2.Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	h, err := r.readHeader(source)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	// The header was read from the start, the chunk of a later offset is
+	// read on its own.
+	index, skip := position(offset)
+	if index > 0 {
+		source.Close()
+		source, err = file.GetAt(ctx, r.ManagerV2, p, int64(headerSize)+index*sealedSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reader := newReader(h, source, index)
+	if _, err := io.CopyN(ioutil.Discard, reader, skip); err != nil {
+		reader.Close()
+		if err == io.EOF {
+			err = &os.PathError{Op: "seek", Path: p, Err: syscall.EINVAL}
+		}
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+type reader struct {
+	header *header
+	source io.ReadCloser
+	input  *bufio.Reader
+	index  int64
+	sealed []byte
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+func newReader(h *header, source io.ReadCloser, index int64) *reader {
+	return &reader{
+		header: h,
+		source: source,
+		input:  bufio.NewReaderSize(source, sealedSize),
+		index:  index,
+		sealed: make([]byte, sealedSize),
+		buf:    make([]byte, 0, ChunkSize),
+	}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done == true {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// next opens the following chunk, which is the last one when nothing follows
+// it.
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.input, r.sealed)
+	final := false
+	switch err {
+	case nil:
+		if _, err := r.input.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		// The last chunk is missing.
+		return ErrInvalid
+	default:
+		return err
+	}
+
+	v, err := r.header.open(r.buf[:0], r.sealed[:n], r.index, final)
+	if err != nil {
+		return err
+	}
+	r.plain = v
+	r.index++
+	r.done = final
+
+	return nil
+}
+
+func (r *reader) Close() error {
+	return r.source.Close()
+}
+
+func (r *Manager) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	h, err := r.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	target, err := r.ManagerV2.Put(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := target.Write(h.encode()); err != nil {
+		file.Abort(target)
+		return nil, err
+	}
+
+	return &writer{header: h, target: target, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+// PutAt keeps the chunks before the offset and rewrites the file from the
+// chunk holding it, with the key the file was written with.
+func (r *Manager) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	if offset == 0 {
+		return r.Put(ctx, p)
+	}
+	if offset < 0 {
+		return nil, &os.PathError{Op: "seek", Path: p, Err: syscall.EINVAL}
+	}
+
+	info, err := r.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if offset > info.Size() {
+		return nil, &os.PathError{Op: "seek", Path: p, Err: syscall.EINVAL}
+	}
+
+	index, skip := position(offset)
+	source, err := r.open(ctx, p, index*ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, skip, ChunkSize)
+	_, err = io.ReadFull(source, buf)
+	h := source.header
+	source.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := file.PutAt(ctx, r.ManagerV2, p, int64(headerSize)+index*sealedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{header: h, target: target, index: index, buf: buf}, nil
+}
+
+func (r *Manager) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	info, err := r.Stat(ctx, p)
+	if os.IsNotExist(err) == true {
+		return r.Put(ctx, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r.PutAt(ctx, p, info.Size())
+}
+
+type writer struct {
+	header *header
+	target io.WriteCloser
+	index  int64
+	buf    []byte
+	sealed []byte
+	done   bool
+}
+
+// Write seals a full chunk only once more data follows, so the last chunk
+// is known on Close.
+func (r *writer) Write(p []byte) (int, error) {
+	if r.done == true {
+		return 0, os.ErrClosed
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		if len(r.buf) == ChunkSize {
+			if err := r.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		size := ChunkSize - len(r.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		r.buf = append(r.buf, p[:size]...)
+		p = p[size:]
+	}
+
+	return n, nil
+}
+
+func (r *writer) flush(final bool) error {
+	sealed, err := r.header.seal(r.sealed[:0], r.buf, r.index, final)
+	if err != nil {
+		return err
+	}
+	r.sealed = sealed
+	if _, err := r.target.Write(sealed); err != nil {
+		return err
+	}
+	r.index++
+	r.buf = r.buf[:0]
+
+	return nil
+}
+
+func (r *writer) Close() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	if err := r.flush(true); err != nil {
+		file.Abort(r.target)
+		return err
+	}
+	return r.target.Close()
+}
+
+func (r *writer) Abort() error {
+	r.done = true
+	return file.Abort(r.target)
+}
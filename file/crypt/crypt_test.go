@@ -0,0 +1,229 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package crypt
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/filetest"
+	"github.com/donamKim/ftp-server-go/file/memory"
+)
+
+const (
+	oldKey = "00112233445566778899aabbccddeeff"
+	newKey = "ffeeddccbbaa99887766554433221100"
+)
+
+func newManager(t *testing.T) (*Manager, *memory.FS, string) {
+	dir, err := ioutil.TempDir("", "crypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(path, []byte("1 "+oldKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := memory.New()
+
+	return New(fs, keys), fs, path
+}
+
+func data(size int) string {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return string(b)
+}
+
+func keyID(t *testing.T, fs *memory.FS, p string) uint32 {
+	t.Helper()
+	b, err := filetest.ReadFile(fs, p, 0)
+	if err != nil || len(b) < headerSize {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	return binary.BigEndian.Uint32(b[len(magic):])
+}
+
+func TestConformance(t *testing.T) {
+	filetest.Run(t, filetest.Backend{New: func(t *testing.T) (file.ManagerV2, string) {
+		m, _, _ := newManager(t)
+		return m, "/"
+	}})
+}
+
+func TestRoundTrip(t *testing.T) {
+	m, fs, _ := newManager(t)
+	ctx := context.Background()
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100} {
+		want := data(size)
+		w, err := m.Put(ctx, "/f")
+		filetest.Write(t, w, err, want)
+
+		got, err := filetest.ReadFile(m, "/f", 0)
+		if err != nil {
+			t.Fatalf("size=%v: %v", size, err)
+		}
+		if string(got) != want {
+			t.Fatalf("size=%v: unexpected data", size)
+		}
+		info, err := m.Stat(ctx, "/f")
+		if err != nil || info.Size() != int64(size) {
+			t.Fatalf("size=%v: unexpected info: %v, err=%v", size, info, err)
+		}
+		raw, err := fs.Stat(ctx, "/f")
+		if err != nil || raw.Size() <= int64(size) {
+			t.Fatalf("size=%v: file is not encrypted: %v, err=%v", size, raw, err)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	m, _, _ := newManager(t)
+	ctx := context.Background()
+	want := data(2*ChunkSize + 500)
+	w, err := m.Put(ctx, "/f")
+	filetest.Write(t, w, err, want)
+
+	for _, offset := range []int64{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 2 * ChunkSize, int64(len(want))} {
+		got, err := filetest.ReadFile(m, "/f", offset)
+		if err != nil {
+			t.Fatalf("offset=%v: %v", offset, err)
+		}
+		if string(got) != want[offset:] {
+			t.Fatalf("offset=%v: unexpected data", offset)
+		}
+	}
+}
+
+func TestPutAt(t *testing.T) {
+	m, _, _ := newManager(t)
+	ctx := context.Background()
+	want := data(ChunkSize + 300)
+	w, err := m.Put(ctx, "/f")
+	filetest.Write(t, w, err, want[:ChunkSize+100])
+
+	w, err = m.PutAt(ctx, "/f", ChunkSize-50)
+	filetest.Write(t, w, err, want[ChunkSize-50:ChunkSize+200])
+	w, err = m.Append(ctx, "/f")
+	filetest.Write(t, w, err, want[ChunkSize+200:])
+
+	got, err := filetest.ReadFile(m, "/f", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatal("unexpected data")
+	}
+	if _, err := m.PutAt(ctx, "/f", int64(len(want))+1); err == nil {
+		t.Fatal("writing beyond the end succeeded")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	m, fs, path := newManager(t)
+	ctx := context.Background()
+	old := data(ChunkSize + 10)
+	w, err := m.Put(ctx, "/old")
+	filetest.Write(t, w, err, old)
+
+	keyfile := "1 " + oldKey + "\n2 " + newKey + "\n"
+	if err := ioutil.WriteFile(path, []byte(keyfile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err = m.Put(ctx, "/new")
+	filetest.Write(t, w, err, "rotated")
+
+	if id := keyID(t, fs, "/old"); id != 1 {
+		t.Fatalf("unexpected key of the old file: %v", id)
+	}
+	if id := keyID(t, fs, "/new"); id != 2 {
+		t.Fatalf("unexpected key of the new file: %v", id)
+	}
+	if got, err := filetest.ReadFile(m, "/old", 0); err != nil || string(got) != old {
+		t.Fatalf("failed to read the old file: %v", err)
+	}
+	if got, err := filetest.ReadFile(m, "/new", 0); err != nil || string(got) != "rotated" {
+		t.Fatalf("failed to read the new file: %q, err=%v", got, err)
+	}
+
+	// Resuming the old file keeps the key it was written with.
+	w, err = m.Append(ctx, "/old")
+	filetest.Write(t, w, err, "more")
+	if id := keyID(t, fs, "/old"); id != 1 {
+		t.Fatalf("unexpected key of the appended file: %v", id)
+	}
+
+	// A removed key makes the files written with it unreadable.
+	if err := ioutil.WriteFile(path, []byte("2 "+newKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := filetest.ReadFile(m, "/old", 0); err == nil {
+		t.Fatal("file with a removed key was read")
+	}
+}
+
+func TestTamper(t *testing.T) {
+	m, fs, _ := newManager(t)
+	ctx := context.Background()
+	want := data(2 * ChunkSize)
+	for _, offset := range []int{len(magic) + 4, headerSize + 20, headerSize + sealedSize + 20} {
+		w, err := m.Put(ctx, "/f")
+		filetest.Write(t, w, err, want)
+
+		raw, err := filetest.ReadFile(fs, "/f", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[offset] ^= 1
+		w, err = fs.Put(ctx, "/f")
+		filetest.Write(t, w, err, string(raw))
+
+		if _, err := filetest.ReadFile(m, "/f", 0); err == nil {
+			t.Fatalf("offset=%v: tampered file was read", offset)
+		}
+	}
+
+	// Truncating at a chunk boundary drops the final chunk.
+	w, err := m.Put(ctx, "/f")
+	filetest.Write(t, w, err, want)
+	raw, err := filetest.ReadFile(fs, "/f", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = fs.Put(ctx, "/f")
+	filetest.Write(t, w, err, string(raw[:headerSize+sealedSize]))
+	if _, err := filetest.ReadFile(m, "/f", 0); err == nil {
+		t.Fatal("truncated file was read")
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring reads the keys from a file of "<id> <hex key>" lines, where a key
+// has 16, 24 or 32 bytes and "#" starts a comment. New files are encrypted
+// with the key of the highest id, and the older keys keep decrypting the
+// files written before. The file is read again when it changes, so a key is
+// rotated by adding a line with a higher id.
+type Keyring struct {
+	Path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+func NewKeyring(path string) (*Keyring, error) {
+	r := &Keyring{Path: path}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// load must be called with the lock held.
+func (r *Keyring) load() error {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		if r.keys != nil {
+			return nil
+		}
+		return err
+	}
+	if r.keys != nil && info.ModTime().Equal(r.modTime) == true && info.Size() == r.size {
+		return nil
+	}
+
+	// A broken keyfile keeps the keys read before, and is read again only
+	// when it changes once more.
+	keys, current, err := parseKeyfile(r.Path)
+	r.modTime, r.size = info.ModTime(), info.Size()
+	if err != nil {
+		if r.keys != nil {
+			log.Printf("failed to reload keyfile: path=%v, err=%v", r.Path, err)
+			return nil
+		}
+		return err
+	}
+	r.keys, r.current = keys, current
+
+	return nil
+}
+
+func parseKeyfile(path string) (map[uint32]cipher.AEAD, uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	keys := make(map[uint32]cipher.AEAD)
+	var current uint32
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan() == true; line++ {
+		s := scanner.Text()
+		if i := strings.Index(s, "#"); i >= 0 {
+			s = s[:i]
+		}
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, 0, fmt.Errorf("invalid keyfile: path=%v, line=%v", path, line)
+		}
+
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid key id: path=%v, line=%v", path, line)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid key: path=%v, line=%v", path, line)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid key: path=%v, line=%v, err=%v", path, line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, ok := keys[uint32(id)]; ok == true {
+			return nil, 0, fmt.Errorf("duplicated key id: path=%v, line=%v", path, line)
+		}
+		keys[uint32(id)] = aead
+		if len(keys) == 1 || uint32(id) > current {
+			current = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("no key in keyfile: path=%v", path)
+	}
+
+	return keys, current, nil
+}
+
+// latest returns the key encrypting new files.
+func (r *Keyring) latest() (uint32, cipher.AEAD, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.load(); err != nil {
+		return 0, nil, err
+	}
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *Keyring) key(id uint32) (cipher.AEAD, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	key, ok := r.keys[id]
+	if ok == false {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
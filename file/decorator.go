@@ -0,0 +1,67 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package file
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// Decorator forwards every operation and capability to ManagerV2. It is
+// embedded by decorators, which override the operations they change. Copy is
+// left out, so a copy streams through the Put of the decorator.
+//
+// Since a decorator implements the capabilities whether the manager below it
+// does or not, a type assertion on a decorated manager tells nothing. Callers
+// use the helper functions of the capabilities, and handle ErrNotSupported.
+type Decorator struct {
+	ManagerV2
+}
+
+func (r Decorator) GetAt(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return GetAt(ctx, r.ManagerV2, path, offset)
+}
+
+func (r Decorator) PutAt(ctx context.Context, path string, offset int64) (io.WriteCloser, error) {
+	return PutAt(ctx, r.ManagerV2, path, offset)
+}
+
+func (r Decorator) Append(ctx context.Context, path string) (io.WriteCloser, error) {
+	return Append(ctx, r.ManagerV2, path)
+}
+
+func (r Decorator) Mkdir(ctx context.Context, path string) error {
+	return Mkdir(ctx, r.ManagerV2, path)
+}
+
+func (r Decorator) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return Chmod(ctx, r.ManagerV2, path, mode)
+}
+
+func (r Decorator) Chtimes(ctx context.Context, path string, modTime time.Time) error {
+	return Chtimes(ctx, r.ManagerV2, path, modTime)
+}
+
+func (r Decorator) Symlink(ctx context.Context, target string, path string) error {
+	return Symlink(ctx, r.ManagerV2, target, path)
+}
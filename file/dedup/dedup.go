@@ -0,0 +1,566 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package dedup stores the contents of files once per SHA-256 digest.
+//
+// Below Dir, the index directory mirrors the directories of the served tree
+// and holds a small entry file of the digest and the size for every file,
+// while the blobs directory holds the contents by digest. The references of
+// the blobs are counted from the index when the store is opened, which also
+// removes the blobs left unreferenced by a crash. When a corrupted entry was
+// skipped, the unreferenced blobs may hold its data, so they are moved to the
+// quarantine directory instead.
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+var ErrCorrupted = errors.New("corrupted index entry")
+
+type Store struct {
+	Dir string
+
+	mutex sync.Mutex
+	refs  map[string]int
+}
+
+type entry struct {
+	digest string
+	size   int64
+}
+
+func New(dir string) (*Store, error) {
+	r := &Store{Dir: filepath.Clean(dir), refs: make(map[string]int)}
+	if err := os.RemoveAll(r.temp()); err != nil {
+		return nil, err
+	}
+	for _, v := range []string{r.index("/"), r.blobs(), r.temp()} {
+		if err := os.MkdirAll(v, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.scan(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Store) index(p string) string {
+	return filepath.Join(r.Dir, "index", filepath.Clean("/"+p))
+}
+
+func (r *Store) blobs() string {
+	return filepath.Join(r.Dir, "blobs")
+}
+
+func (r *Store) blob(digest string) string {
+	return filepath.Join(r.blobs(), digest[:2], digest)
+}
+
+func (r *Store) temp() string {
+	return filepath.Join(r.Dir, "tmp")
+}
+
+func (r *Store) quarantine() string {
+	return filepath.Join(r.Dir, "quarantine")
+}
+
+// scan counts the references of the blobs, and removes the unreferenced ones.
+// A corrupted entry is skipped, so it does not keep the store from opening,
+// and the unreferenced blobs are quarantined rather than removed.
+func (r *Store) scan() error {
+	corrupted := false
+	err := filepath.Walk(r.index("/"), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode().IsRegular() == false {
+			return err
+		}
+		e, err := readEntry(p)
+		if err == ErrCorrupted {
+			log.Printf("failed to read index entry: path=%v, err=%v", p, err)
+			corrupted = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.refs[e.digest]++
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(r.blobs(), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode().IsRegular() == false {
+			return err
+		}
+		if r.refs[info.Name()] > 0 {
+			return nil
+		}
+		if corrupted == false {
+			return os.Remove(p)
+		}
+		if err := os.MkdirAll(r.quarantine(), 0755); err != nil {
+			return err
+		}
+		log.Printf("quarantined unreferenced blob: digest=%v", info.Name())
+
+		return os.Rename(p, filepath.Join(r.quarantine(), info.Name()))
+	})
+}
+
+func readEntry(p string) (entry, error) {
+	var e entry
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return e, err
+	}
+	if _, err := fmt.Sscanf(string(b), "%s %d", &e.digest, &e.size); err != nil {
+		return e, ErrCorrupted
+	}
+	if _, err := hex.DecodeString(e.digest); err != nil || len(e.digest) != sha256.Size*2 {
+		return e, ErrCorrupted
+	}
+
+	return e, nil
+}
+
+// writeEntry replaces the entry through a temporary file, keeping the mode of
+// the entry it replaces.
+func (r *Store) writeEntry(p string, e entry) error {
+	f, err := ioutil.TempFile(r.temp(), "entry")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%v %v\n", e.digest, e.size)
+	if err == nil {
+		if info, errStat := os.Stat(p); errStat == nil {
+			err = f.Chmod(info.Mode().Perm())
+		} else {
+			err = f.Chmod(0644)
+		}
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// release drops a reference of the blob, removing it with the last one. It
+// must be called with the lock held.
+func (r *Store) release(digest string) {
+	r.refs[digest]--
+	if r.refs[digest] > 0 {
+		return
+	}
+	delete(r.refs, digest)
+	if err := os.Remove(r.blob(digest)); err != nil {
+		log.Printf("failed to remove blob: digest=%v, err=%v", digest, err)
+	}
+}
+
+// logical replaces the index path of an error with the path of the tree.
+func logical(err error, p string) error {
+	switch v := err.(type) {
+	case *os.PathError:
+		return &os.PathError{Op: v.Op, Path: p, Err: v.Err}
+	case *os.LinkError:
+		return &os.PathError{Op: v.Op, Path: p, Err: v.Err}
+	}
+	return err
+}
+
+func (r *Store) info(p string, fi os.FileInfo) (*file.Info, error) {
+	info := file.NewInfo(fi)
+	if fi.Mode().IsRegular() == false {
+		return info, nil
+	}
+
+	e, err := readEntry(p)
+	if err != nil {
+		return nil, err
+	}
+	attr := info.Attr()
+	attr.Size = e.size
+
+	return attr.Info(), nil
+}
+
+func (r *Store) Stat(ctx context.Context, p string) (*file.Info, error) {
+	fi, err := os.Lstat(r.index(p))
+	if err != nil {
+		return nil, logical(err, p)
+	}
+	info, err := r.info(r.index(p), fi)
+	if err != nil {
+		return nil, logical(err, p)
+	}
+
+	return info, nil
+}
+
+func (r *Store) List(ctx context.Context, p string) ([]*file.Info, error) {
+	fi, err := os.Lstat(r.index(p))
+	if err != nil {
+		return nil, logical(err, p)
+	}
+	if fi.IsDir() == false {
+		return []*file.Info{}, nil
+	}
+
+	children, err := ioutil.ReadDir(r.index(p))
+	if err != nil {
+		return nil, logical(err, p)
+	}
+	list := make([]*file.Info, 0, len(children))
+	for _, v := range children {
+		info, err := r.info(filepath.Join(r.index(p), v.Name()), v)
+		if err != nil {
+			return nil, logical(err, filepath.Join(p, v.Name()))
+		}
+		list = append(list, info)
+	}
+
+	return list, nil
+}
+
+func (r *Store) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	return r.GetAt(ctx, p, 0)
+}
+
+func (r *Store) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	f, err := r.open(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, logical(err, p)
+	}
+
+	return f, nil
+}
+
+// open opens the blob of the file, which stays readable when the file is
+// replaced or removed later.
+func (r *Store) open(p string) (*os.File, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	fi, err := os.Stat(r.index(p))
+	if err != nil {
+		return nil, logical(err, p)
+	}
+	if fi.IsDir() == true {
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+	}
+	e, err := readEntry(r.index(p))
+	if err != nil {
+		return nil, logical(err, p)
+	}
+
+	f, err := os.Open(r.blob(e.digest))
+	if err != nil {
+		return nil, logical(err, p)
+	}
+
+	return f, nil
+}
+
+func (r *Store) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	return r.newWriter(p, 0)
+}
+
+// PutAt starts the new content with the first offset bytes of the file,
+// extended with zeros when it is shorter.
+func (r *Store) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	return r.newWriter(p, offset)
+}
+
+func (r *Store) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	return r.newWriter(p, -1)
+}
+
+type writer struct {
+	store *Store
+	path  string
+	f     *os.File
+	hash  hash.Hash
+	size  int64
+	done  bool
+}
+
+func (r *Store) newWriter(p string, offset int64) (*writer, error) {
+	if offset < 0 && offset != -1 {
+		return nil, &os.PathError{Op: "seek", Path: p, Err: syscall.EINVAL}
+	}
+	if fi, err := os.Stat(filepath.Dir(r.index(p))); err != nil {
+		return nil, logical(err, p)
+	} else if fi.IsDir() == false {
+		return nil, &os.PathError{Op: "create", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	f, err := ioutil.TempFile(r.temp(), "blob")
+	if err != nil {
+		return nil, err
+	}
+	w := &writer{store: r, path: p, f: f, hash: sha256.New()}
+	if offset != 0 {
+		if err := w.init(offset); err != nil {
+			w.Abort()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// init copies the first offset bytes of the file, or all of them when offset
+// is -1.
+func (r *writer) init(offset int64) error {
+	src, err := r.store.open(r.path)
+	if os.IsNotExist(err) == true {
+		src, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var n int64
+	if src != nil {
+		defer src.Close()
+		var reader io.Reader = src
+		if offset >= 0 {
+			reader = io.LimitReader(src, offset)
+		}
+		if n, err = io.Copy(r, reader); err != nil {
+			return err
+		}
+	}
+	if offset > n {
+		_, err = io.CopyN(r, zeros{}, offset-n)
+	}
+
+	return err
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (r *writer) Write(p []byte) (int, error) {
+	if r.done == true {
+		return 0, os.ErrClosed
+	}
+	n, err := r.f.Write(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *writer) Close() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	err := r.f.Sync()
+	if errClose := r.f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		e := entry{digest: hex.EncodeToString(r.hash.Sum(nil)), size: r.size}
+		err = r.store.commit(r.path, r.f.Name(), e)
+	}
+	if err != nil {
+		os.Remove(r.f.Name())
+	}
+
+	return err
+}
+
+func (r *writer) Abort() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	r.f.Close()
+	return os.Remove(r.f.Name())
+}
+
+// commit moves the temporary file to the blob of the digest unless the blob
+// is already stored, and then points the entry of the path to it.
+func (r *Store) commit(p string, temp string, e entry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	blob := r.blob(e.digest)
+	if _, err := os.Stat(blob); os.IsNotExist(err) == true {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(temp, blob); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		os.Remove(temp)
+	}
+
+	r.refs[e.digest]++
+	old, errOld := readEntry(r.index(p))
+	if err := r.writeEntry(r.index(p), e); err != nil {
+		r.release(e.digest)
+		return logical(err, p)
+	}
+	if errOld == nil {
+		r.release(old.digest)
+	}
+
+	return nil
+}
+
+func (r *Store) Remove(ctx context.Context, p string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	fi, err := os.Lstat(r.index(p))
+	if err != nil {
+		return logical(err, p)
+	}
+	if fi.Mode().IsRegular() == false {
+		return logical(os.Remove(r.index(p)), p)
+	}
+
+	e, err := readEntry(r.index(p))
+	if err != nil {
+		return logical(err, p)
+	}
+	if err := os.Remove(r.index(p)); err != nil {
+		return logical(err, p)
+	}
+	r.release(e.digest)
+
+	return nil
+}
+
+// Rename moves the entries only, releasing the file it replaces.
+func (r *Store) Rename(ctx context.Context, old string, new string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var replaced *entry
+	if fi, err := os.Lstat(r.index(new)); err == nil && fi.Mode().IsRegular() == true && r.index(old) != r.index(new) {
+		if e, err := readEntry(r.index(new)); err == nil {
+			replaced = &e
+		}
+	}
+	if err := os.Rename(r.index(old), r.index(new)); err != nil {
+		if v, ok := err.(*os.LinkError); ok == true {
+			return &os.LinkError{Op: v.Op, Old: old, New: new, Err: v.Err}
+		}
+		return err
+	}
+	if replaced != nil {
+		r.release(replaced.digest)
+	}
+
+	return nil
+}
+
+// Copy adds an entry referencing the blob of the file.
+func (r *Store) Copy(ctx context.Context, src string, dst string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	fi, err := os.Stat(r.index(src))
+	if err != nil {
+		return logical(err, src)
+	}
+	if fi.IsDir() == true {
+		return &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	}
+	if fi, err := os.Stat(filepath.Dir(r.index(dst))); err != nil {
+		return logical(err, dst)
+	} else if fi.IsDir() == false {
+		return &os.PathError{Op: "copy", Path: dst, Err: syscall.ENOTDIR}
+	}
+	e, err := readEntry(r.index(src))
+	if err != nil {
+		return logical(err, src)
+	}
+
+	r.refs[e.digest]++
+	old, errOld := readEntry(r.index(dst))
+	if err := r.writeEntry(r.index(dst), e); err != nil {
+		r.release(e.digest)
+		return logical(err, dst)
+	}
+	if errOld == nil {
+		r.release(old.digest)
+	}
+
+	return nil
+}
+
+func (r *Store) Mkdir(ctx context.Context, p string) error {
+	return logical(os.Mkdir(r.index(p), 0777), p)
+}
+
+func (r *Store) Chmod(ctx context.Context, p string, mode os.FileMode) error {
+	return logical(os.Chmod(r.index(p), mode), p)
+}
+
+func (r *Store) Chtimes(ctx context.Context, p string, modTime time.Time) error {
+	return logical(os.Chtimes(r.index(p), modTime, modTime), p)
+}
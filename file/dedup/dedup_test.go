@@ -0,0 +1,264 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package dedup
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/filetest"
+)
+
+func newStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// blobs returns the reference counts by the content stored, with the blobs
+// on disk which have to match them.
+func blobs(t *testing.T, s *Store) map[string]int {
+	refs := make(map[string]int)
+	err := filepath.Walk(s.blobs(), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() == true {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if s.refs[info.Name()] == 0 {
+			t.Errorf("blob without references: %q", b)
+		}
+		refs[string(b)] = s.refs[info.Name()]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != len(s.refs) {
+		t.Errorf("references without blobs: %v", s.refs)
+	}
+	return refs
+}
+
+func check(t *testing.T, s *Store, want map[string]int) {
+	t.Helper()
+	got := blobs(t, s)
+	if len(got) != len(want) {
+		t.Fatalf("unexpected blobs: %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("unexpected references: %v, want %v", got, want)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	filetest.Run(t, filetest.Backend{New: func(t *testing.T) (file.ManagerV2, string) {
+		return newStore(t), "/"
+	}})
+}
+
+func TestReferences(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+
+	w, err := s.Put(ctx, "/a")
+	filetest.Write(t, w, err, "same")
+	w, err = s.Put(ctx, "/b")
+	filetest.Write(t, w, err, "same")
+	check(t, s, map[string]int{"same": 2})
+
+	if err := s.Copy(ctx, "/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, s, map[string]int{"same": 3})
+
+	w, err = s.Put(ctx, "/d")
+	filetest.Write(t, w, err, "other")
+	if err := s.Rename(ctx, "/a", "/d"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, s, map[string]int{"same": 3})
+	if v := filetest.Read(t, s, "/d", 0); v != "same" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+
+	w, err = s.Put(ctx, "/b")
+	filetest.Write(t, w, err, "changed")
+	check(t, s, map[string]int{"same": 2, "changed": 1})
+
+	for _, v := range []string{"/c", "/d"} {
+		if err := s.Remove(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, s, map[string]int{"changed": 1})
+	if err := s.Copy(ctx, "/missing", "/e"); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error for a missing file: %v", err)
+	}
+}
+
+func TestRangedWrites(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+
+	w, err := s.Put(ctx, "/f")
+	filetest.Write(t, w, err, "hello world")
+	if err := s.Copy(ctx, "/f", "/g"); err != nil {
+		t.Fatal(err)
+	}
+	w, err = s.PutAt(ctx, "/f", 5)
+	filetest.Write(t, w, err, "!")
+	w, err = s.Append(ctx, "/f")
+	filetest.Write(t, w, err, "?")
+	if v := filetest.Read(t, s, "/f", 0); v != "hello!?" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	if v := filetest.Read(t, s, "/g", 6); v != "world" {
+		t.Fatalf("shared blob changed: %q", v)
+	}
+	info, err := s.Stat(ctx, "/f")
+	if err != nil || info.Size() != 7 {
+		t.Fatalf("unexpected info: %v, err=%v", info, err)
+	}
+	check(t, s, map[string]int{"hello!?": 1, "hello world": 1})
+
+	w, err = s.Put(ctx, "/h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "aborted")
+	if err := file.Abort(w); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "/h"); os.IsNotExist(err) == false {
+		t.Fatalf("aborted file exists: %v", err)
+	}
+	check(t, s, map[string]int{"hello!?": 1, "hello world": 1})
+}
+
+func TestRecovery(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	w, err := s.Put(ctx, "/a")
+	filetest.Write(t, w, err, "kept")
+	if err := s.Copy(ctx, "/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	w, err = s.Put(ctx, "/c")
+	filetest.Write(t, w, err, "lost")
+
+	// A crash between writing a blob and its entry leaves an unreferenced
+	// blob and a temporary file behind.
+	e, err := readEntry(s.index("/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.index("/c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.temp(), "upload"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(s.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, reopened, map[string]int{"kept": 2})
+	if _, err := os.Stat(reopened.blob(e.digest)); os.IsNotExist(err) == false {
+		t.Fatalf("unreferenced blob was kept: %v", err)
+	}
+	list, err := ioutil.ReadDir(reopened.temp())
+	if err != nil || len(list) != 0 {
+		t.Fatalf("temporary files were kept: %v, err=%v", list, err)
+	}
+	if v := filetest.Read(t, reopened, "/b", 0); v != "kept" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	w, err := s.Put(ctx, "/a")
+	filetest.Write(t, w, err, "kept")
+	w, err = s.Put(ctx, "/broken")
+	filetest.Write(t, w, err, "lost")
+
+	// The blob of a corrupted entry is unreferenced, but it is the only copy
+	// of the data left.
+	e, err := readEntry(s.index("/broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.index("/broken"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(s.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, reopened, map[string]int{"kept": 1})
+	b, err := ioutil.ReadFile(filepath.Join(reopened.quarantine(), e.digest))
+	if err != nil || string(b) != "lost" {
+		t.Fatalf("unreferenced blob was not quarantined: %q, err=%v", b, err)
+	}
+	if v := filetest.Read(t, reopened, "/a", 0); v != "kept" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+}
+
+func TestMissingBlob(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	w, err := s.Put(ctx, "/a")
+	filetest.Write(t, w, err, "data")
+	e, err := readEntry(s.index("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.blob(e.digest)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Get(ctx, "/a")
+	v, ok := err.(*os.PathError)
+	if ok == false || v.Path != "/a" || os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package driver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type atomicWriter struct {
+	f    *os.File
+	path string
+	done bool
+}
+
+// newAtomicWriter creates the temporary file of path, starting with the
+// first offset bytes of the file or with all of them when offset is -1.
+func newAtomicWriter(path string, offset int64) (*atomicWriter, error) {
+	f, err := createTemp(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &atomicWriter{f: f, path: path}
+
+	if err := w.init(offset); err != nil {
+		w.Abort()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (r *atomicWriter) init(offset int64) error {
+	src, err := os.Open(r.path)
+	if os.IsNotExist(err) == true {
+		return r.seek(offset)
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err := r.f.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if offset == 0 {
+		return nil
+	}
+
+	if offset < 0 {
+		_, err = io.Copy(r.f, src)
+		return err
+	}
+	if _, err := io.CopyN(r.f, src, offset); err != nil && err != io.EOF {
+		return err
+	}
+	return r.seek(offset)
+}
+
+// seek extends the file with zeros up to the offset like PutAt of a file
+// shorter than the offset.
+func (r *atomicWriter) seek(offset int64) error {
+	if offset <= 0 {
+		return nil
+	}
+	if err := r.f.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := r.f.Seek(offset, io.SeekStart)
+
+	return err
+}
+
+func (r *atomicWriter) Write(p []byte) (int, error) {
+	return r.f.Write(p)
+}
+
+// Close flushes the temporary file to the disk before renaming it, so the
+// file is never seen half written even after a crash.
+func (r *atomicWriter) Close() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	err := r.f.Sync()
+	if errClose := r.f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(r.f.Name(), r.path)
+	}
+	if err != nil {
+		os.Remove(r.f.Name())
+	}
+
+	return err
+}
+
+func (r *atomicWriter) Abort() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	r.f.Close()
+	return os.Remove(r.f.Name())
+}
+
+func createTemp(path string) (*os.File, error) {
+	dir, name := filepath.Split(path)
+	buf := make([]byte, 4)
+	for i := 0; i < 100; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+
+		temp := filepath.Join(dir, "."+name+"."+hex.EncodeToString(buf)+".tmp")
+		f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) == true {
+			continue
+		}
+		return f, err
+	}
+
+	return nil, errors.New("failed to create temporary file")
+}
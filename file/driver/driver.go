@@ -21,16 +21,25 @@
 package driver
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/donamKim/ftp-server-go/file"
 )
 
-type Driver struct{}
+// Driver is the local file system. With Atomic, uploads are written to a
+// hidden temporary file in the same directory which replaces the file only
+// when the writer was closed; resumed and appended uploads start from a copy
+// of the file.
+type Driver struct {
+	Atomic bool
+}
 
-func (r *Driver) Stat(path string) (*file.Info, error) {
+func (r *Driver) Stat(ctx context.Context, path string) (*file.Info, error) {
 	f, err := os.Lstat(path)
 	if err != nil {
 		return nil, err
@@ -39,12 +48,15 @@ func (r *Driver) Stat(path string) (*file.Info, error) {
 	return file.NewInfo(f), nil
 }
 
-func (r *Driver) List(path string) ([]*file.Info, error) {
+func (r *Driver) List(ctx context.Context, path string) ([]*file.Info, error) {
 	list := make([]*file.Info, 0)
 	err := filepath.Walk(path, func(p string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if p == path {
 			return nil
 		}
@@ -64,36 +76,122 @@ func (r *Driver) List(path string) ([]*file.Info, error) {
 	return list, nil
 }
 
-func (r *Driver) Get(path string) (io.Reader, error) {
+func (r *Driver) Get(ctx context.Context, path string) (io.ReadCloser, error) {
+	return r.GetAt(ctx, path, 0)
+}
+
+func (r *Driver) GetAt(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
 		return nil, err
 	}
 
 	return f, nil
 }
 
-func (r *Driver) Put(path string, reader io.Reader) error {
+func (r *Driver) Put(ctx context.Context, path string) (io.WriteCloser, error) {
+	if r.Atomic == true {
+		return newAtomicWriter(path, 0)
+	}
+
 	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// PutAt truncates the file to the offset and writes from there on.
+func (r *Driver) PutAt(ctx context.Context, path string, offset int64) (io.WriteCloser, error) {
+	if r.Atomic == true {
+		return newAtomicWriter(path, offset)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (r *Driver) Append(ctx context.Context, path string) (io.WriteCloser, error) {
+	if r.Atomic == true {
+		return newAtomicWriter(path, -1)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Copy writes like Put, which lets the kernel copy the data between plain
+// files.
+func (r *Driver) Copy(ctx context.Context, src string, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
 	if err != nil {
 		return err
 	}
+	if info.IsDir() == true {
+		return &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	}
 
-	if _, err := io.Copy(f, reader); err != nil {
+	w, err := r.Put(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		file.Abort(w)
 		return err
 	}
 
-	return nil
+	return w.Close()
 }
 
-func (r *Driver) Remove(path string) error {
+func (r *Driver) Remove(ctx context.Context, path string) error {
 	return os.Remove(path)
 }
 
-func (r *Driver) Rename(old string, new string) error {
+func (r *Driver) Rename(ctx context.Context, old string, new string) error {
 	return os.Rename(old, new)
 }
+
+func (r *Driver) Mkdir(ctx context.Context, path string) error {
+	return os.Mkdir(path, 0777)
+}
+
+func (r *Driver) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return os.Chmod(path, mode)
+}
+
+func (r *Driver) Symlink(ctx context.Context, target string, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (r *Driver) Chtimes(ctx context.Context, path string, modTime time.Time) error {
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,349 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package filetest runs the conformance cases of file.ManagerV2 against a
+// backend, and provides the helpers the tests of the backends share.
+package filetest
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// Backend creates the managers under test.
+type Backend struct {
+	// New returns a new manager with the directory the cases work below,
+	// which exists and is empty.
+	New func(t *testing.T) (file.ManagerV2, string)
+
+	// ImplicitDirs is set for a backend creating the parents of a file,
+	// like an object storage.
+	ImplicitDirs bool
+}
+
+var cases = []struct {
+	name string
+	fn   func(t *testing.T, backend Backend, m file.ManagerV2, root string)
+}{
+	{"ReadWrite", testReadWrite},
+	{"PutAt", testPutAt},
+	{"Append", testAppend},
+	{"Mkdir", testMkdir},
+	{"List", testList},
+	{"Remove", testRemove},
+	{"Rename", testRename},
+	{"Copy", testCopy},
+}
+
+// Run runs every case against a new manager of the backend. A case of an
+// optional operation is skipped when the manager does not support it.
+func Run(t *testing.T, backend Backend) {
+	for _, v := range cases {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			m, root := backend.New(t)
+			v.fn(t, backend, m, root)
+		})
+	}
+}
+
+// Write writes data to the writer of Put and closes it.
+func Write(t *testing.T, w io.WriteCloser, err error, data string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Create writes data to a new file and leaves the writer open.
+func Create(t *testing.T, m file.ManagerV2, p string, data string) io.WriteCloser {
+	t.Helper()
+	w, err := m.Put(context.Background(), p)
+	if err != nil {
+		t.Fatalf("failed to put: path=%v, err=%v", p, err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("failed to write: path=%v, err=%v", p, err)
+	}
+	return w
+}
+
+// Put writes data to a file.
+func Put(t *testing.T, m file.ManagerV2, p string, data string) {
+	t.Helper()
+	if err := Create(t, m, p, data).Close(); err != nil {
+		t.Fatalf("failed to close: path=%v, err=%v", p, err)
+	}
+}
+
+// ReadFile returns the data of a file from the offset on.
+func ReadFile(m file.ManagerV2, p string, offset int64) ([]byte, error) {
+	reader, err := file.GetAt(context.Background(), m, p, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// Read returns the data of a file from the offset on, failing the test when
+// it cannot be read.
+func Read(t *testing.T, m file.ManagerV2, p string, offset int64) string {
+	t.Helper()
+	b, err := ReadFile(m, p, offset)
+	if err != nil {
+		t.Fatalf("failed to read: path=%v, err=%v", p, err)
+	}
+	return string(b)
+}
+
+// Names returns the names of a directory in the order of List, with a slash
+// after the names of directories.
+func Names(t *testing.T, m file.ManagerV2, p string) []string {
+	t.Helper()
+	list, err := m.List(context.Background(), p)
+	if err != nil {
+		t.Fatalf("failed to list: path=%v, err=%v", p, err)
+	}
+	v := make([]string, 0, len(list))
+	for _, info := range list {
+		name := info.Name()
+		if info.IsDir() == true {
+			name += "/"
+		}
+		v = append(v, name)
+	}
+	return v
+}
+
+func mkdir(t *testing.T, m file.ManagerV2, p string) {
+	t.Helper()
+	err := file.Mkdir(context.Background(), m, p)
+	if err == file.ErrNotSupported {
+		t.Skip("Mkdir is not supported")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testReadWrite(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	p := filepath.Join(root, "f")
+	Put(t, m, p, "hello world")
+	if v := Read(t, m, p, 0); v != "hello world" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	if v := Read(t, m, p, 6); v != "world" {
+		t.Fatalf("unexpected data at offset: %q", v)
+	}
+	if v := Read(t, m, p, 11); v != "" {
+		t.Fatalf("unexpected data at the end: %q", v)
+	}
+	info, err := m.Stat(ctx, p)
+	if err != nil || info.Size() != 11 || info.IsDir() == true {
+		t.Fatalf("unexpected info: %v, err=%v", info, err)
+	}
+
+	Put(t, m, p, "short")
+	if v := Read(t, m, p, 0); v != "short" {
+		t.Fatalf("Put did not replace the file: %q", v)
+	}
+
+	if _, err := m.Get(ctx, filepath.Join(root, "missing")); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of Get for a missing file: %v", err)
+	}
+	if _, err := m.Stat(ctx, filepath.Join(root, "missing")); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of Stat for a missing file: %v", err)
+	}
+	if backend.ImplicitDirs == false {
+		if _, err := m.Put(ctx, filepath.Join(root, "missing", "f")); os.IsNotExist(err) == false {
+			t.Fatalf("unexpected error without a parent: %v", err)
+		}
+	}
+}
+
+func testPutAt(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	p := filepath.Join(root, "f")
+	Put(t, m, p, "hello world")
+
+	w, err := file.PutAt(ctx, m, p, 5)
+	if err == file.ErrNotSupported {
+		t.Skip("PutAt is not supported")
+	}
+	Write(t, w, err, "!")
+	if v := Read(t, m, p, 0); v != "hello!" {
+		t.Fatalf("PutAt did not truncate: %q", v)
+	}
+	w, err = file.PutAt(ctx, m, p, 6)
+	Write(t, w, err, "?")
+	if v := Read(t, m, p, 0); v != "hello!?" {
+		t.Fatalf("PutAt did not continue at the end: %q", v)
+	}
+}
+
+func testAppend(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	p := filepath.Join(root, "f")
+	Put(t, m, p, "hello")
+
+	w, err := file.Append(ctx, m, p)
+	if err == file.ErrNotSupported {
+		t.Skip("Append is not supported")
+	}
+	Write(t, w, err, " world")
+	if v := Read(t, m, p, 0); v != "hello world" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	info, err := m.Stat(ctx, p)
+	if err != nil || info.Size() != 11 {
+		t.Fatalf("unexpected info: %v, err=%v", info, err)
+	}
+}
+
+func testMkdir(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	p := filepath.Join(root, "d")
+	mkdir(t, m, p)
+
+	info, err := m.Stat(ctx, p)
+	if err != nil || info.IsDir() == false {
+		t.Fatalf("unexpected info: %v, err=%v", info, err)
+	}
+	if v := Names(t, m, p); len(v) != 0 {
+		t.Fatalf("unexpected list of a new directory: %v", v)
+	}
+	if err := file.Mkdir(ctx, m, p); os.IsExist(err) == false {
+		t.Fatalf("unexpected error for an existing directory: %v", err)
+	}
+}
+
+func testList(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	mkdir(t, m, filepath.Join(root, "d"))
+	mkdir(t, m, filepath.Join(root, "d", "sub"))
+	for _, v := range []string{"b", "a", "sub/c"} {
+		Put(t, m, filepath.Join(root, "d", v), v)
+	}
+
+	names := Names(t, m, filepath.Join(root, "d"))
+	sort.Strings(names)
+	if reflect.DeepEqual(names, []string{"a", "b", "sub/"}) == false {
+		t.Fatalf("unexpected list: %v", names)
+	}
+	list, err := m.List(ctx, filepath.Join(root, "d", "a"))
+	if err != nil || list == nil || len(list) != 0 {
+		t.Fatalf("unexpected list of a file: %v, err=%v", list, err)
+	}
+	if _, err := m.List(ctx, filepath.Join(root, "missing")); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error for a missing directory: %v", err)
+	}
+}
+
+func testRemove(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	mkdir(t, m, filepath.Join(root, "d"))
+	Put(t, m, filepath.Join(root, "d", "f"), "data")
+
+	if err := m.Remove(ctx, filepath.Join(root, "d")); err == nil {
+		t.Fatal("removed a directory which is not empty")
+	}
+	if err := m.Remove(ctx, filepath.Join(root, "d", "f")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat(ctx, filepath.Join(root, "d", "f")); os.IsNotExist(err) == false {
+		t.Fatalf("removed file still exists: %v", err)
+	}
+	if err := m.Remove(ctx, filepath.Join(root, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat(ctx, filepath.Join(root, "d")); os.IsNotExist(err) == false {
+		t.Fatalf("removed directory still exists: %v", err)
+	}
+	if err := m.Remove(ctx, filepath.Join(root, "d")); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error for a missing file: %v", err)
+	}
+}
+
+func testRename(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	mkdir(t, m, filepath.Join(root, "d"))
+	Put(t, m, filepath.Join(root, "d", "f"), "data")
+
+	if err := m.Rename(ctx, filepath.Join(root, "d"), filepath.Join(root, "e")); err != nil {
+		t.Fatal(err)
+	}
+	if v := Read(t, m, filepath.Join(root, "e", "f"), 0); v != "data" {
+		t.Fatalf("unexpected data after rename: %q", v)
+	}
+	if _, err := m.Stat(ctx, filepath.Join(root, "d")); os.IsNotExist(err) == false {
+		t.Fatalf("renamed directory still exists: %v", err)
+	}
+
+	Put(t, m, filepath.Join(root, "g"), "other")
+	if err := m.Rename(ctx, filepath.Join(root, "g"), filepath.Join(root, "e", "f")); err != nil {
+		t.Fatal(err)
+	}
+	if v := Read(t, m, filepath.Join(root, "e", "f"), 0); v != "other" {
+		t.Fatalf("rename did not replace the file: %q", v)
+	}
+	if _, err := m.Stat(ctx, filepath.Join(root, "g")); os.IsNotExist(err) == false {
+		t.Fatalf("renamed file still exists: %v", err)
+	}
+	if err := m.Rename(ctx, filepath.Join(root, "missing"), filepath.Join(root, "h")); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error for a missing file: %v", err)
+	}
+}
+
+func testCopy(t *testing.T, backend Backend, m file.ManagerV2, root string) {
+	ctx := context.Background()
+	Put(t, m, filepath.Join(root, "f"), "data")
+	if err := file.Copy(ctx, m, filepath.Join(root, "f"), filepath.Join(root, "g")); err != nil {
+		t.Fatal(err)
+	}
+	Put(t, m, filepath.Join(root, "f"), "changed")
+	if v := Read(t, m, filepath.Join(root, "g"), 0); v != "data" {
+		t.Fatalf("copy changed with the source: %q", v)
+	}
+
+	mkdir(t, m, filepath.Join(root, "d"))
+	if err := file.Copy(ctx, m, filepath.Join(root, "d"), filepath.Join(root, "h")); err == nil {
+		t.Fatal("copied a directory")
+	}
+	if err := file.Copy(ctx, m, filepath.Join(root, "missing"), filepath.Join(root, "h")); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error for a missing file: %v", err)
+	}
+}
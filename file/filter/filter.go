@@ -0,0 +1,204 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package filter hides files of a file.ManagerV2 matching glob or regular
+// expression rules, as if they did not exist.
+package filter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+type Manager struct {
+	file.Decorator
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// New compiles the rules. A rule is a glob pattern matched against every
+// name of a path, so ".git" hides the directory with its contents, or a
+// regular expression matched against the whole path with a "regex:" prefix.
+// A "glob:" prefix is optional.
+func New(manager file.ManagerV2, rules []string) (*Manager, error) {
+	r := &Manager{Decorator: file.Decorator{ManagerV2: manager}}
+	for _, v := range rules {
+		switch {
+		case strings.HasPrefix(v, "regex:"):
+			re, err := regexp.Compile(strings.TrimPrefix(v, "regex:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule: rule=%v, err=%v", v, err)
+			}
+			r.regexps = append(r.regexps, re)
+		default:
+			pattern := strings.TrimPrefix(v, "glob:")
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid rule: rule=%v, err=%v", v, err)
+			}
+			r.globs = append(r.globs, pattern)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Manager) Hidden(p string) bool {
+	p = filepath.Clean(p)
+	for _, v := range r.regexps {
+		if v.MatchString(p) == true {
+			return true
+		}
+	}
+	for _, name := range strings.Split(p, string(filepath.Separator)) {
+		if len(name) == 0 {
+			continue
+		}
+		for _, v := range r.globs {
+			if ok, _ := filepath.Match(v, name); ok == true {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func notExist(op string, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+func (r *Manager) Stat(ctx context.Context, p string) (*file.Info, error) {
+	if r.Hidden(p) == true {
+		return nil, notExist("stat", p)
+	}
+	return r.ManagerV2.Stat(ctx, p)
+}
+
+func (r *Manager) List(ctx context.Context, p string) ([]*file.Info, error) {
+	if r.Hidden(p) == true {
+		return nil, notExist("list", p)
+	}
+	list, err := r.ManagerV2.List(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]*file.Info, 0, len(list))
+	for _, v := range list {
+		if r.Hidden(filepath.Join(p, v.Name())) == false {
+			visible = append(visible, v)
+		}
+	}
+	return visible, nil
+}
+
+func (r *Manager) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	if r.Hidden(p) == true {
+		return nil, notExist("open", p)
+	}
+	return r.ManagerV2.Get(ctx, p)
+}
+
+func (r *Manager) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	if r.Hidden(p) == true {
+		return nil, notExist("open", p)
+	}
+	return file.GetAt(ctx, r.ManagerV2, p, offset)
+}
+
+// Put refuses to create a hidden file, which could not be seen afterwards.
+func (r *Manager) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	if r.Hidden(p) == true {
+		return nil, &os.PathError{Op: "create", Path: p, Err: os.ErrPermission}
+	}
+	return r.ManagerV2.Put(ctx, p)
+}
+
+func (r *Manager) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	if r.Hidden(p) == true {
+		return nil, &os.PathError{Op: "create", Path: p, Err: os.ErrPermission}
+	}
+	return file.PutAt(ctx, r.ManagerV2, p, offset)
+}
+
+func (r *Manager) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	if r.Hidden(p) == true {
+		return nil, &os.PathError{Op: "append", Path: p, Err: os.ErrPermission}
+	}
+	return file.Append(ctx, r.ManagerV2, p)
+}
+
+func (r *Manager) Remove(ctx context.Context, p string) error {
+	if r.Hidden(p) == true {
+		return notExist("remove", p)
+	}
+	return r.ManagerV2.Remove(ctx, p)
+}
+
+func (r *Manager) Rename(ctx context.Context, old string, new string) error {
+	if r.Hidden(old) == true {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrNotExist}
+	}
+	if r.Hidden(new) == true {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrPermission}
+	}
+	return r.ManagerV2.Rename(ctx, old, new)
+}
+
+func (r *Manager) Mkdir(ctx context.Context, p string) error {
+	if r.Hidden(p) == true {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrPermission}
+	}
+	return file.Mkdir(ctx, r.ManagerV2, p)
+}
+
+func (r *Manager) Chmod(ctx context.Context, p string, mode os.FileMode) error {
+	if r.Hidden(p) == true {
+		return notExist("chmod", p)
+	}
+	return file.Chmod(ctx, r.ManagerV2, p, mode)
+}
+
+func (r *Manager) Chtimes(ctx context.Context, p string, modTime time.Time) error {
+	if r.Hidden(p) == true {
+		return notExist("chtimes", p)
+	}
+	return file.Chtimes(ctx, r.ManagerV2, p, modTime)
+}
+
+// Symlink refuses a link to a hidden file as well, which would show it.
+func (r *Manager) Symlink(ctx context.Context, target string, p string) error {
+	resolved := target
+	if filepath.IsAbs(resolved) == false {
+		resolved = filepath.Join(filepath.Dir(p), target)
+	}
+	if r.Hidden(p) == true || r.Hidden(resolved) == true {
+		return &os.PathError{Op: "symlink", Path: p, Err: os.ErrPermission}
+	}
+	return file.Symlink(ctx, r.ManagerV2, target, p)
+}
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 )
 
 type Info struct {
@@ -36,7 +37,7 @@ type Info struct {
 func NewInfo(info os.FileInfo) *Info {
 	v := new(Info)
 	v.FileInfo = info
-	if stat := v.Sys().(*syscall.Stat_t); stat != nil {
+	if stat, ok := v.Sys().(*syscall.Stat_t); ok == true && stat != nil {
 		v.Uid = stat.Uid
 		v.Gid = stat.Gid
 	}
@@ -44,6 +45,36 @@ func NewInfo(info os.FileInfo) *Info {
 	return v
 }
 
+// Attr is the plain form of Info for managers that do not stat a local
+// file, and for passing file information across process boundaries.
+type Attr struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Uid     uint32
+	Gid     uint32
+}
+
+func (r Attr) Info() *Info {
+	return &Info{FileInfo: &attrInfo{attr: r}, Uid: r.Uid, Gid: r.Gid}
+}
+
+func (r *Info) Attr() Attr {
+	return Attr{Name: r.Name(), Size: r.Size(), Mode: r.Mode(), ModTime: r.ModTime(), Uid: r.Uid, Gid: r.Gid}
+}
+
+type attrInfo struct {
+	attr Attr
+}
+
+func (r *attrInfo) Name() string       { return r.attr.Name }
+func (r *attrInfo) Size() int64        { return r.attr.Size }
+func (r *attrInfo) Mode() os.FileMode  { return r.attr.Mode }
+func (r *attrInfo) ModTime() time.Time { return r.attr.ModTime }
+func (r *attrInfo) IsDir() bool        { return r.attr.Mode.IsDir() }
+func (r *attrInfo) Sys() interface{}   { return nil }
+
 func (r *Info) Encode() []byte {
 	var buf bytes.Buffer
 	if r.IsDir() == true {
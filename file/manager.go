@@ -20,7 +20,18 @@
 
 package file
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var ErrNotSupported = errors.New("file: operation not supported")
 
 type Manager interface {
 	Stat(path string) (*Info, error)
@@ -30,3 +41,199 @@ type Manager interface {
 	Remove(path string) error
 	Rename(old string, new string) error
 }
+
+// ManagerV2 is the context-aware successor of Manager. The caller closes
+// what Get and Put return; a write is complete only when Close succeeded.
+// Optional operations are the capability interfaces below, called through
+// the helper functions of the same name, which fall back to
+// ErrNotSupported. The capabilities are not asserted by the callers
+// directly, since decorators implement all of them and report
+// ErrNotSupported from the manager below.
+type ManagerV2 interface {
+	Stat(ctx context.Context, path string) (*Info, error)
+	List(ctx context.Context, path string) ([]*Info, error)
+	Get(ctx context.Context, path string) (io.ReadCloser, error)
+	Put(ctx context.Context, path string) (io.WriteCloser, error)
+	Remove(ctx context.Context, path string) error
+	Rename(ctx context.Context, old string, new string) error
+}
+
+type Mkdirer interface {
+	Mkdir(ctx context.Context, path string) error
+}
+
+type Chmoder interface {
+	Chmod(ctx context.Context, path string, mode os.FileMode) error
+}
+
+type Chtimeser interface {
+	Chtimes(ctx context.Context, path string, modTime time.Time) error
+}
+
+type Appender interface {
+	Append(ctx context.Context, path string) (io.WriteCloser, error)
+}
+
+// RangeGetter reads a file from the offset on, for resumed downloads.
+type RangeGetter interface {
+	GetAt(ctx context.Context, path string, offset int64) (io.ReadCloser, error)
+}
+
+// RangePutter writes a file from the offset on, for resumed uploads.
+type RangePutter interface {
+	PutAt(ctx context.Context, path string, offset int64) (io.WriteCloser, error)
+}
+
+// Symlinker creates a symbolic link at path to target, which is stored as
+// given.
+type Symlinker interface {
+	Symlink(ctx context.Context, target string, path string) error
+}
+
+// Copier copies a file without passing its data through the session, like
+// the server side copy of an object storage.
+type Copier interface {
+	Copy(ctx context.Context, src string, dst string) error
+}
+
+// Aborter is implemented by writers of Put that can discard an incomplete
+// write instead of committing it on Close.
+type Aborter interface {
+	Abort() error
+}
+
+func Mkdir(ctx context.Context, m ManagerV2, path string) error {
+	if v, ok := m.(Mkdirer); ok == true {
+		return v.Mkdir(ctx, path)
+	}
+	return ErrNotSupported
+}
+
+func Chmod(ctx context.Context, m ManagerV2, path string, mode os.FileMode) error {
+	if v, ok := m.(Chmoder); ok == true {
+		return v.Chmod(ctx, path, mode)
+	}
+	return ErrNotSupported
+}
+
+func Chtimes(ctx context.Context, m ManagerV2, path string, modTime time.Time) error {
+	if v, ok := m.(Chtimeser); ok == true {
+		return v.Chtimes(ctx, path, modTime)
+	}
+	return ErrNotSupported
+}
+
+func Append(ctx context.Context, m ManagerV2, path string) (io.WriteCloser, error) {
+	if v, ok := m.(Appender); ok == true {
+		return v.Append(ctx, path)
+	}
+	return nil, ErrNotSupported
+}
+
+func Symlink(ctx context.Context, m ManagerV2, target string, path string) error {
+	if v, ok := m.(Symlinker); ok == true {
+		return v.Symlink(ctx, target, path)
+	}
+	return ErrNotSupported
+}
+
+// Copy falls back to streaming the file from Get to Put. Directories are not
+// copied.
+func Copy(ctx context.Context, m ManagerV2, src string, dst string) error {
+	if v, ok := m.(Copier); ok == true {
+		return v.Copy(ctx, src, dst)
+	}
+
+	info, err := m.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() == true {
+		return &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	}
+	reader, err := m.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := m.Put(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		Abort(writer)
+		return err
+	}
+
+	return writer.Close()
+}
+
+// GetAt falls back to skipping the first offset bytes of Get.
+func GetAt(ctx context.Context, m ManagerV2, path string, offset int64) (io.ReadCloser, error) {
+	if v, ok := m.(RangeGetter); ok == true {
+		return v.GetAt(ctx, path, offset)
+	}
+
+	reader, err := m.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func PutAt(ctx context.Context, m ManagerV2, path string, offset int64) (io.WriteCloser, error) {
+	if v, ok := m.(RangePutter); ok == true {
+		return v.PutAt(ctx, path, offset)
+	}
+	return nil, ErrNotSupported
+}
+
+// Abort discards the write when the writer supports it, and closes it
+// otherwise.
+func Abort(w io.WriteCloser) error {
+	if v, ok := w.(Aborter); ok == true {
+		return v.Abort()
+	}
+	return w.Close()
+}
+
+// MkdirAll creates a directory with the missing parents.
+func MkdirAll(ctx context.Context, m ManagerV2, path string) error {
+	if _, err := m.Stat(ctx, path); err == nil {
+		return nil
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := MkdirAll(ctx, m, parent); err != nil {
+			return err
+		}
+	}
+
+	return Mkdir(ctx, m, path)
+}
+
+// RemoveAll removes a file or a directory with its contents.
+func RemoveAll(ctx context.Context, m ManagerV2, path string) error {
+	info, err := m.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() == true {
+		list, err := m.List(ctx, path)
+		if err != nil {
+			return err
+		}
+		for _, v := range list {
+			if err := RemoveAll(ctx, m, filepath.Join(path, v.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return m.Remove(ctx, path)
+}
@@ -0,0 +1,423 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package memory implements a thread-safe file.Manager keeping everything in
+// memory, for tests and ephemeral servers.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+type FS struct {
+	// Uid and Gid are the owner of the files and directories created later.
+	Uid uint32
+	Gid uint32
+
+	mutex sync.RWMutex
+	nodes map[string]*node
+}
+
+type node struct {
+	mode    os.FileMode
+	modTime time.Time
+	uid     uint32
+	gid     uint32
+	data    []byte
+}
+
+func New() *FS {
+	return &FS{
+		nodes: map[string]*node{
+			"/": {mode: os.ModeDir | 0755, modTime: time.Now()},
+		},
+	}
+}
+
+func clean(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (r *FS) info(p string, n *node) *file.Info {
+	return file.Attr{
+		Name:    path.Base(p),
+		Size:    int64(len(n.data)),
+		Mode:    n.mode,
+		ModTime: n.modTime,
+		Uid:     n.uid,
+		Gid:     n.gid,
+	}.Info()
+}
+
+func (r *FS) Stat(ctx context.Context, p string) (*file.Info, error) {
+	p = clean(p)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	n, ok := r.nodes[p]
+	if ok == false {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+
+	return r.info(p, n), nil
+}
+
+// List of a file is empty, as for the local file system.
+func (r *FS) List(ctx context.Context, p string) ([]*file.Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p = clean(p)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	n, ok := r.nodes[p]
+	if ok == false {
+		return nil, &os.PathError{Op: "list", Path: p, Err: os.ErrNotExist}
+	}
+	if n.mode.IsDir() == false {
+		return []*file.Info{}, nil
+	}
+
+	names := r.children(p)
+	sort.Strings(names)
+	list := make([]*file.Info, 0, len(names))
+	for _, v := range names {
+		list = append(list, r.info(v, r.nodes[v]))
+	}
+
+	return list, nil
+}
+
+func (r *FS) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	return r.GetAt(ctx, p, 0)
+}
+
+func (r *FS) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	p = clean(p)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	n, ok := r.nodes[p]
+	if ok == false {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	if n.mode.IsDir() == true {
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+	}
+	if offset < 0 || offset > int64(len(n.data)) {
+		return nil, &os.PathError{Op: "seek", Path: p, Err: syscall.EINVAL}
+	}
+
+	// The slice is never modified in place, a write replaces it.
+	return ioutil.NopCloser(bytes.NewReader(n.data[offset:])), nil
+}
+
+// Put returns a writer buffering the data, which replaces the file on Close.
+func (r *FS) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	return r.newWriter("create", p, 0)
+}
+
+func (r *FS) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	if offset < 0 {
+		return nil, &os.PathError{Op: "seek", Path: p, Err: syscall.EINVAL}
+	}
+	return r.newWriter("create", p, offset)
+}
+
+func (r *FS) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	return r.newWriter("append", p, -1)
+}
+
+func (r *FS) newWriter(op string, p string, offset int64) (io.WriteCloser, error) {
+	p = clean(p)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if err := r.checkParent(op, p); err != nil {
+		return nil, err
+	}
+	if n, ok := r.nodes[p]; ok == true && n.mode.IsDir() == true {
+		return nil, &os.PathError{Op: op, Path: p, Err: syscall.EISDIR}
+	}
+
+	return &writer{fs: r, op: op, path: p, offset: offset}, nil
+}
+
+// commit writes data at the offset of the file, or at its end when the
+// offset is negative. The file is cut at the offset, as PutAt of the driver
+// truncates it.
+func (r *FS) commit(op string, p string, offset int64, data []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.checkParent(op, p); err != nil {
+		return err
+	}
+	n, ok := r.nodes[p]
+	if ok == false {
+		n = &node{mode: 0644, uid: r.Uid, gid: r.Gid}
+	}
+	if n.mode.IsDir() == true {
+		return &os.PathError{Op: op, Path: p, Err: syscall.EISDIR}
+	}
+	if offset < 0 {
+		offset = int64(len(n.data))
+	}
+
+	// An offset beyond the end is filled with zeros, like a truncate which
+	// extends a file.
+	v := make([]byte, offset, int(offset)+len(data))
+	copy(v, n.data)
+	n.data = append(v, data...)
+	n.modTime = time.Now()
+	r.nodes[p] = n
+
+	return nil
+}
+
+type writer struct {
+	fs     *FS
+	op     string
+	path   string
+	offset int64
+	buf    bytes.Buffer
+	done   bool
+}
+
+func (r *writer) Write(p []byte) (int, error) {
+	if r.done == true {
+		return 0, os.ErrClosed
+	}
+	return r.buf.Write(p)
+}
+
+func (r *writer) Close() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	return r.fs.commit(r.op, r.path, r.offset, r.buf.Bytes())
+}
+
+// Abort discards the buffered data, leaving the file untouched.
+func (r *writer) Abort() error {
+	r.done = true
+	r.buf.Reset()
+
+	return nil
+}
+
+func (r *FS) Remove(ctx context.Context, p string) error {
+	p = clean(p)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	n, ok := r.nodes[p]
+	if ok == false {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	if p == "/" || (n.mode.IsDir() == true && len(r.children(p)) > 0) {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+	}
+	delete(r.nodes, p)
+
+	return nil
+}
+
+func (r *FS) Rename(ctx context.Context, old string, new string) error {
+	old, new = clean(old), clean(new)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	n, ok := r.nodes[old]
+	if ok == false {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrNotExist}
+	}
+	if old == new {
+		return nil
+	}
+	if old == "/" || strings.HasPrefix(new, old+"/") == true {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: syscall.EINVAL}
+	}
+	if err := r.checkParent("rename", new); err != nil {
+		return err
+	}
+	if target, ok := r.nodes[new]; ok == true {
+		if target.mode.IsDir() != n.mode.IsDir() || len(r.children(new)) > 0 {
+			return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrExist}
+		}
+	}
+
+	moved := map[string]*node{new: n}
+	for k, v := range r.nodes {
+		if strings.HasPrefix(k, old+"/") == true {
+			moved[new+k[len(old):]] = v
+		}
+	}
+	for k := range r.nodes {
+		if k == old || strings.HasPrefix(k, old+"/") == true {
+			delete(r.nodes, k)
+		}
+	}
+	for k, v := range moved {
+		r.nodes[k] = v
+	}
+
+	return nil
+}
+
+// Copy shares the data of the file, which is never modified in place.
+func (r *FS) Copy(ctx context.Context, src string, dst string) error {
+	src, dst = clean(src), clean(dst)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	n, ok := r.nodes[src]
+	if ok == false {
+		return &os.PathError{Op: "copy", Path: src, Err: os.ErrNotExist}
+	}
+	if n.mode.IsDir() == true {
+		return &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	}
+	if err := r.checkParent("copy", dst); err != nil {
+		return err
+	}
+	if target, ok := r.nodes[dst]; ok == true && target.mode.IsDir() == true {
+		return &os.PathError{Op: "copy", Path: dst, Err: syscall.EISDIR}
+	}
+	r.nodes[dst] = &node{mode: n.mode, modTime: time.Now(), uid: r.Uid, gid: r.Gid, data: n.data}
+
+	return nil
+}
+
+func (r *FS) Mkdir(ctx context.Context, p string) error {
+	p = clean(p)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.nodes[p]; ok == true {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+	if err := r.checkParent("mkdir", p); err != nil {
+		return err
+	}
+	r.nodes[p] = &node{mode: os.ModeDir | 0755, modTime: time.Now(), uid: r.Uid, gid: r.Gid}
+
+	return nil
+}
+
+func (r *FS) MkdirAll(p string) error {
+	p = clean(p)
+	if p == "/" {
+		return nil
+	}
+	if err := r.MkdirAll(path.Dir(p)); err != nil {
+		return err
+	}
+
+	err := r.Mkdir(context.Background(), p)
+	if os.IsExist(err) == true {
+		if info, _ := r.Stat(context.Background(), p); info != nil && info.IsDir() == true {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *FS) Chown(p string, uid uint32, gid uint32) error {
+	return r.update("chown", p, func(n *node) {
+		n.uid = uid
+		n.gid = gid
+	})
+}
+
+func (r *FS) Chmod(ctx context.Context, p string, mode os.FileMode) error {
+	return r.update("chmod", p, func(n *node) {
+		n.mode = (n.mode &^ os.ModePerm) | (mode & os.ModePerm)
+	})
+}
+
+func (r *FS) Chtimes(ctx context.Context, p string, modTime time.Time) error {
+	return r.update("chtimes", p, func(n *node) {
+		n.modTime = modTime
+	})
+}
+
+func (r *FS) update(op string, p string, fn func(n *node)) error {
+	p = clean(p)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	n, ok := r.nodes[p]
+	if ok == false {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	fn(n)
+
+	return nil
+}
+
+// checkParent must be called with a lock held.
+func (r *FS) checkParent(op string, p string) error {
+	parent, ok := r.nodes[path.Dir(p)]
+	if ok == false {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	if parent.mode.IsDir() == false {
+		return &os.PathError{Op: op, Path: p, Err: syscall.ENOTDIR}
+	}
+
+	return nil
+}
+
+// children must be called with a lock held.
+func (r *FS) children(p string) []string {
+	names := make([]string, 0)
+	for k := range r.nodes {
+		if k != p && path.Dir(k) == p {
+			names = append(names, k)
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,79 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package memory
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/driver"
+	"github.com/donamKim/ftp-server-go/file/filetest"
+)
+
+// TestConformance runs the memory file system and the local driver, which it
+// has to behave like, through the same cases.
+func TestConformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		filetest.Run(t, filetest.Backend{New: func(t *testing.T) (file.ManagerV2, string) {
+			return New(), "/"
+		}})
+	})
+	t.Run("driver", func(t *testing.T) {
+		filetest.Run(t, filetest.Backend{New: func(t *testing.T) (file.ManagerV2, string) {
+			dir, err := ioutil.TempDir("", "memory")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			return &driver.Driver{}, dir
+		}})
+	})
+}
+
+func TestPutAtExtends(t *testing.T) {
+	fs := New()
+	ctx := context.Background()
+	filetest.Put(t, fs, "/f", "hello!")
+	w, err := file.PutAt(ctx, fs, "/f", 8)
+	filetest.Write(t, w, err, "x")
+	if v := filetest.Read(t, fs, "/f", 0); v != "hello!\x00\x00x" {
+		t.Fatalf("PutAt did not extend: %q", v)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	fs := New()
+	filetest.Put(t, fs, "/f", "data")
+
+	w := filetest.Create(t, fs, "/f", "partial")
+	if v := filetest.Read(t, fs, "/f", 0); v != "data" {
+		t.Fatalf("write visible before close: %q", v)
+	}
+	if err := file.Abort(w); err != nil {
+		t.Fatal(err)
+	}
+	if v := filetest.Read(t, fs, "/f", 0); v != "data" {
+		t.Fatalf("aborted write replaced the file: %q", v)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package mount composes several file managers into one namespace, routing
+// every path to the manager mounted at its longest prefix.
+package mount
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+type mount struct {
+	path    string
+	target  string
+	manager file.ManagerV2
+}
+
+// Table is the mount table. Directories above the mount points which are not
+// mounted themselves are synthesized, and cannot be changed.
+type Table struct {
+	// CopyRename moves files across mounts by copying and removing them,
+	// where Rename fails with EXDEV otherwise.
+	CopyRename bool
+
+	mounts []*mount
+}
+
+func New() *Table {
+	return new(Table)
+}
+
+// Mount serves the paths below path from the manager, mapped below target.
+// It is not safe to call while the table is used.
+func (r *Table) Mount(path string, manager file.ManagerV2, target string) {
+	path, target = clean(path), clean(target)
+	for i, v := range r.mounts {
+		if v.path == path {
+			r.mounts = append(r.mounts[:i], r.mounts[i+1:]...)
+			break
+		}
+	}
+
+	r.mounts = append(r.mounts, &mount{path: path, target: target, manager: manager})
+	sort.Slice(r.mounts, func(i, j int) bool {
+		return len(r.mounts[i].path) > len(r.mounts[j].path)
+	})
+}
+
+func clean(p string) string {
+	return filepath.Clean(string(filepath.Separator) + p)
+}
+
+// within reports whether p is base or below it.
+func within(p string, base string) bool {
+	if base == string(filepath.Separator) {
+		return true
+	}
+	return p == base || strings.HasPrefix(p, base+string(filepath.Separator))
+}
+
+// route returns the mount of p with the path of p in its manager.
+func (r *Table) route(p string) (*mount, string) {
+	p = clean(p)
+	for _, v := range r.mounts {
+		if within(p, v.path) == true {
+			return v, filepath.Join(v.target, strings.TrimPrefix(p, v.path))
+		}
+	}
+
+	return nil, ""
+}
+
+// children returns the names of the mount points right below p which are
+// not served by the manager of p.
+func (r *Table) children(p string) []string {
+	p = clean(p)
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, v := range r.mounts {
+		if v.path == p || within(v.path, p) == false {
+			continue
+		}
+		rest := strings.TrimPrefix(strings.TrimPrefix(v.path, p), string(filepath.Separator))
+		name := strings.SplitN(rest, string(filepath.Separator), 2)[0]
+		if seen[name] == false {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (r *Table) virtual(p string) bool {
+	return len(r.children(p)) > 0
+}
+
+func dirInfo(name string) *file.Info {
+	return file.Attr{Name: name, Mode: os.ModeDir | 0755}.Info()
+}
+
+func notExist(op string, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+func denied(op string, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+}
+
+func (r *Table) Stat(ctx context.Context, p string) (*file.Info, error) {
+	m, inner := r.route(p)
+	if m == nil {
+		if r.virtual(p) == true {
+			return dirInfo(filepath.Base(clean(p))), nil
+		}
+		return nil, notExist("stat", p)
+	}
+
+	info, err := m.manager.Stat(ctx, inner)
+	if err != nil && os.IsNotExist(err) == true && r.virtual(p) == true {
+		return dirInfo(filepath.Base(clean(p))), nil
+	}
+
+	return info, err
+}
+
+func (r *Table) List(ctx context.Context, p string) ([]*file.Info, error) {
+	list := make([]*file.Info, 0)
+	m, inner := r.route(p)
+	if m != nil {
+		var err error
+		if list, err = m.manager.List(ctx, inner); err != nil {
+			if os.IsNotExist(err) == false || r.virtual(p) == false {
+				return nil, err
+			}
+			list = make([]*file.Info, 0)
+		}
+	} else if r.virtual(p) == false {
+		return nil, notExist("list", p)
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range list {
+		seen[v.Name()] = true
+	}
+	for _, v := range r.children(p) {
+		if seen[v] == false {
+			list = append(list, dirInfo(v))
+		}
+	}
+
+	return list, nil
+}
+
+func (r *Table) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	return r.GetAt(ctx, p, 0)
+}
+
+func (r *Table) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	m, inner := r.route(p)
+	if m == nil {
+		return nil, notExist("open", p)
+	}
+
+	return file.GetAt(ctx, m.manager, inner, offset)
+}
+
+func (r *Table) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	m, inner := r.route(p)
+	if m == nil {
+		return nil, denied("create", p)
+	}
+
+	return m.manager.Put(ctx, inner)
+}
+
+func (r *Table) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	m, inner := r.route(p)
+	if m == nil {
+		return nil, denied("create", p)
+	}
+
+	return file.PutAt(ctx, m.manager, inner, offset)
+}
+
+func (r *Table) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	m, inner := r.route(p)
+	if m == nil {
+		return nil, denied("append", p)
+	}
+
+	return file.Append(ctx, m.manager, inner)
+}
+
+// Remove refuses mount points and the directories above them.
+func (r *Table) Remove(ctx context.Context, p string) error {
+	m, inner := r.route(p)
+	if m == nil || m.path == clean(p) || r.virtual(p) == true {
+		return denied("remove", p)
+	}
+
+	return m.manager.Remove(ctx, inner)
+}
+
+// Rename refuses mount points and the directories above them on both sides.
+func (r *Table) Rename(ctx context.Context, old string, new string) error {
+	oldMount, oldInner := r.route(old)
+	newMount, newInner := r.route(new)
+	if oldMount == nil || oldMount.path == clean(old) || r.virtual(old) == true {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrPermission}
+	}
+	if newMount == nil || newMount.path == clean(new) || r.virtual(new) == true {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrPermission}
+	}
+	if oldMount == newMount {
+		return oldMount.manager.Rename(ctx, oldInner, newInner)
+	}
+	if r.CopyRename == false {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: syscall.EXDEV}
+	}
+
+	if err := copyTree(ctx, oldMount.manager, oldInner, newMount.manager, newInner); err != nil {
+		return err
+	}
+	return file.RemoveAll(ctx, oldMount.manager, oldInner)
+}
+
+// Copy is native within a mount, and streamed between mounts.
+func (r *Table) Copy(ctx context.Context, src string, dst string) error {
+	srcMount, srcInner := r.route(src)
+	dstMount, dstInner := r.route(dst)
+	if srcMount == nil {
+		if r.virtual(src) == true {
+			return &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+		}
+		return notExist("copy", src)
+	}
+	if dstMount == nil || dstMount.path == clean(dst) || r.virtual(dst) == true {
+		return &os.LinkError{Op: "copy", Old: src, New: dst, Err: os.ErrPermission}
+	}
+	if srcMount == dstMount {
+		return file.Copy(ctx, srcMount.manager, srcInner, dstInner)
+	}
+
+	return copyFile(ctx, srcMount.manager, srcInner, dstMount.manager, dstInner)
+}
+
+func (r *Table) Mkdir(ctx context.Context, p string) error {
+	m, inner := r.route(p)
+	if m == nil || m.path == clean(p) {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+
+	return file.Mkdir(ctx, m.manager, inner)
+}
+
+// Symlink maps the target to the mount of the link, which it has to stay
+// within. A relative target is resolved against the directory of the link,
+// and stored relative to the link again, since the manager would resolve it
+// against its own directories.
+func (r *Table) Symlink(ctx context.Context, target string, p string) error {
+	m, inner := r.route(p)
+	if m == nil || m.path == clean(p) {
+		return denied("symlink", p)
+	}
+	resolved := target
+	if filepath.IsAbs(target) == false {
+		resolved = filepath.Join(filepath.Dir(clean(p)), target)
+	}
+	targetMount, targetInner := r.route(resolved)
+	if targetMount != m {
+		return &os.LinkError{Op: "symlink", Old: target, New: p, Err: syscall.EXDEV}
+	}
+	if filepath.IsAbs(target) == true {
+		target = targetInner
+	} else {
+		rel, err := filepath.Rel(filepath.Dir(inner), targetInner)
+		if err != nil {
+			return &os.LinkError{Op: "symlink", Old: target, New: p, Err: err}
+		}
+		target = rel
+	}
+
+	return file.Symlink(ctx, m.manager, target, inner)
+}
+
+func (r *Table) Chmod(ctx context.Context, p string, mode os.FileMode) error {
+	m, inner := r.route(p)
+	if m == nil {
+		return denied("chmod", p)
+	}
+
+	return file.Chmod(ctx, m.manager, inner, mode)
+}
+
+func (r *Table) Chtimes(ctx context.Context, p string, modTime time.Time) error {
+	m, inner := r.route(p)
+	if m == nil {
+		return denied("chtimes", p)
+	}
+
+	return file.Chtimes(ctx, m.manager, inner, modTime)
+}
+
+// copyTree copies a file or a directory with its contents between managers.
+func copyTree(ctx context.Context, src file.ManagerV2, srcPath string, dst file.ManagerV2, dstPath string) error {
+	info, err := src.Stat(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() == false {
+		return copyFile(ctx, src, srcPath, dst, dstPath)
+	}
+
+	if err := file.Mkdir(ctx, dst, dstPath); err != nil {
+		return err
+	}
+	list, err := src.List(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		if err := copyTree(ctx, src, filepath.Join(srcPath, v.Name()), dst, filepath.Join(dstPath, v.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(ctx context.Context, src file.ManagerV2, srcPath string, dst file.ManagerV2, dstPath string) error {
+	reader, err := src.Get(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := dst.Put(ctx, dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		file.Abort(writer)
+		return err
+	}
+
+	return writer.Close()
+}
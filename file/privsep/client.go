@@ -0,0 +1,271 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package privsep
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/driver"
+)
+
+// Client is a file.ManagerV2 forwarding every operation to a helper process.
+type Client struct {
+	cmd    *exec.Cmd
+	client *rpc.Client
+}
+
+// Start re-executes the running binary as a helper with the credential,
+// serving the local file system with the options of d. The calling process
+// needs the privilege to switch to it, normally root. A nil credential keeps
+// the identity of the calling process.
+func Start(credential *syscall.Credential, d *driver.Driver) (*Client, error) {
+	cmd, err := helperCommand(credential, d.Atomic)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return newClient(&pipe{Reader: reader, Writer: writer, closers: []io.Closer{writer, reader}}, cmd), nil
+}
+
+// newClient talks to the helper over conn. The cmd of a helper started by a
+// Spawner is nil, which then waits for it.
+func newClient(conn io.ReadWriteCloser, cmd *exec.Cmd) *Client {
+	return &Client{cmd: cmd, client: rpc.NewClient(conn)}
+}
+
+func helperCommand(credential *syscall.Credential, atomic bool) (*exec.Cmd, error) {
+	path, err := executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), envHelper+"=1")
+	if atomic == true {
+		cmd.Env = append(cmd.Env, envAtomic+"=1")
+	}
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+
+	return cmd, nil
+}
+
+func (r *Client) Close() error {
+	r.client.Close()
+	if r.cmd == nil {
+		return nil
+	}
+	return r.cmd.Wait()
+}
+
+// call returns when the context is done without waiting for the helper,
+// whose late reply is then discarded.
+func (r *Client) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	call := r.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return decodeError(call.Error)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Client) Stat(ctx context.Context, path string) (*file.Info, error) {
+	var attr file.Attr
+	if err := r.call(ctx, "Manager.Stat", PathArgs{Path: path}, &attr); err != nil {
+		return nil, err
+	}
+
+	return attr.Info(), nil
+}
+
+func (r *Client) List(ctx context.Context, path string) ([]*file.Info, error) {
+	var attrs []file.Attr
+	if err := r.call(ctx, "Manager.List", PathArgs{Path: path}, &attrs); err != nil {
+		return nil, err
+	}
+
+	list := make([]*file.Info, 0, len(attrs))
+	for _, v := range attrs {
+		list = append(list, v.Info())
+	}
+	return list, nil
+}
+
+func (r *Client) Get(ctx context.Context, path string) (io.ReadCloser, error) {
+	return r.GetAt(ctx, path, 0)
+}
+
+func (r *Client) GetAt(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var handle uint64
+	if err := r.call(ctx, "Manager.Open", OpenArgs{Path: path, Offset: offset}, &handle); err != nil {
+		return nil, err
+	}
+
+	return &reader{ctx: ctx, client: r, handle: handle}, nil
+}
+
+func (r *Client) Put(ctx context.Context, path string) (io.WriteCloser, error) {
+	return r.create(ctx, CreateArgs{Path: path})
+}
+
+func (r *Client) PutAt(ctx context.Context, path string, offset int64) (io.WriteCloser, error) {
+	return r.create(ctx, CreateArgs{Path: path, Offset: offset})
+}
+
+func (r *Client) Append(ctx context.Context, path string) (io.WriteCloser, error) {
+	return r.create(ctx, CreateArgs{Path: path, Append: true})
+}
+
+func (r *Client) create(ctx context.Context, args CreateArgs) (io.WriteCloser, error) {
+	var handle uint64
+	if err := r.call(ctx, "Manager.Create", args, &handle); err != nil {
+		return nil, err
+	}
+
+	return &writer{ctx: ctx, client: r, handle: handle}, nil
+}
+
+func (r *Client) Remove(ctx context.Context, path string) error {
+	return r.call(ctx, "Manager.Remove", PathArgs{Path: path}, &struct{}{})
+}
+
+func (r *Client) Rename(ctx context.Context, old string, new string) error {
+	return r.call(ctx, "Manager.Rename", RenameArgs{Old: old, New: new}, &struct{}{})
+}
+
+// Copy runs in the helper, so the data never crosses the pipe.
+func (r *Client) Copy(ctx context.Context, src string, dst string) error {
+	return r.call(ctx, "Manager.Copy", RenameArgs{Old: src, New: dst}, &struct{}{})
+}
+
+func (r *Client) Mkdir(ctx context.Context, path string) error {
+	return r.call(ctx, "Manager.Mkdir", PathArgs{Path: path}, &struct{}{})
+}
+
+func (r *Client) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return r.call(ctx, "Manager.Chmod", ModeArgs{Path: path, Mode: mode}, &struct{}{})
+}
+
+func (r *Client) Symlink(ctx context.Context, target string, path string) error {
+	return r.call(ctx, "Manager.Symlink", RenameArgs{Old: target, New: path}, &struct{}{})
+}
+
+func (r *Client) Chtimes(ctx context.Context, path string, modTime time.Time) error {
+	return r.call(ctx, "Manager.Chtimes", TimeArgs{Path: path, ModTime: modTime}, &struct{}{})
+}
+
+type reader struct {
+	ctx    context.Context
+	client *Client
+	handle uint64
+	closed bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.closed == true {
+		return 0, io.EOF
+	}
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+
+	var data []byte
+	err := r.client.call(r.ctx, "Manager.Read", ReadArgs{Handle: r.handle, Size: len(p)}, &data)
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(p, data), nil
+}
+
+// Close releases the remote handle even when the context was canceled.
+func (r *reader) Close() error {
+	if r.closed == true {
+		return nil
+	}
+	r.closed = true
+
+	return r.client.call(context.Background(), "Manager.Close", r.handle, &struct{}{})
+}
+
+type writer struct {
+	ctx    context.Context
+	client *Client
+	handle uint64
+	closed bool
+}
+
+func (r *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		var n int
+		err := r.client.call(r.ctx, "Manager.Write", WriteArgs{Handle: r.handle, Data: chunk}, &n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (r *writer) Close() error {
+	if r.closed == true {
+		return nil
+	}
+	r.closed = true
+
+	return r.client.call(context.Background(), "Manager.Close", r.handle, &struct{}{})
+}
+
+func (r *writer) Abort() error {
+	if r.closed == true {
+		return nil
+	}
+	r.closed = true
+
+	return r.client.call(context.Background(), "Manager.Abort", r.handle, &struct{}{})
+}
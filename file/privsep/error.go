@@ -0,0 +1,140 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package privsep
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/rpc"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// errorPrefix marks the error strings of the RPC replies which hold a
+// remoteError.
+const errorPrefix = "privsep: "
+
+// sentinels are the errors compared by identity, like io.EOF at the end of a
+// file or file.ErrNotSupported for the capabilities.
+var sentinels = map[string]error{
+	"eof":           io.EOF,
+	"unexpectedEOF": io.ErrUnexpectedEOF,
+	"notSupported":  file.ErrNotSupported,
+	"notExist":      os.ErrNotExist,
+	"exist":         os.ErrExist,
+	"permission":    os.ErrPermission,
+	"invalid":       os.ErrInvalid,
+	"canceled":      context.Canceled,
+	"deadline":      context.DeadlineExceeded,
+}
+
+// remoteError carries an error of the helper across net/rpc, which passes
+// errors as strings only. It keeps the errno and the path and link errors
+// around it, so os.IsNotExist and the like work on the client as on the
+// local file system.
+type remoteError struct {
+	Kind  string
+	Op    string        `json:",omitempty"`
+	Path  string        `json:",omitempty"`
+	New   string        `json:",omitempty"`
+	Errno syscall.Errno `json:",omitempty"`
+	Text  string        `json:",omitempty"`
+	Err   *remoteError  `json:",omitempty"`
+}
+
+func newRemoteError(err error) *remoteError {
+	if err == nil {
+		return nil
+	}
+
+	switch v := err.(type) {
+	case *os.PathError:
+		return &remoteError{Kind: "path", Op: v.Op, Path: v.Path, Err: newRemoteError(v.Err)}
+	case *os.LinkError:
+		return &remoteError{Kind: "link", Op: v.Op, Path: v.Old, New: v.New, Err: newRemoteError(v.Err)}
+	case *os.SyscallError:
+		return &remoteError{Kind: "syscall", Op: v.Syscall, Err: newRemoteError(v.Err)}
+	case syscall.Errno:
+		return &remoteError{Kind: "errno", Errno: v}
+	}
+	for k, v := range sentinels {
+		if err == v {
+			return &remoteError{Kind: k}
+		}
+	}
+
+	return &remoteError{Kind: "text", Text: err.Error()}
+}
+
+func (r *remoteError) error() error {
+	if r == nil {
+		return nil
+	}
+
+	switch r.Kind {
+	case "path":
+		return &os.PathError{Op: r.Op, Path: r.Path, Err: r.Err.error()}
+	case "link":
+		return &os.LinkError{Op: r.Op, Old: r.Path, New: r.New, Err: r.Err.error()}
+	case "syscall":
+		return os.NewSyscallError(r.Op, r.Err.error())
+	case "errno":
+		return r.Errno
+	}
+	if err, ok := sentinels[r.Kind]; ok == true {
+		return err
+	}
+
+	return errors.New(r.Text)
+}
+
+// encodeError is returned by the methods of the service.
+func encodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	b, jsonErr := json.Marshal(newRemoteError(err))
+	if jsonErr != nil {
+		return err
+	}
+
+	return errors.New(errorPrefix + string(b))
+}
+
+// decodeError rebuilds the error of the helper. Errors of net/rpc itself are
+// returned as they are.
+func decodeError(err error) error {
+	s, ok := err.(rpc.ServerError)
+	if ok == false || strings.HasPrefix(string(s), errorPrefix) == false {
+		return err
+	}
+	v := new(remoteError)
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(string(s), errorPrefix)), v); err != nil {
+		return s
+	}
+
+	return v.error()
+}
@@ -0,0 +1,308 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package privsep runs file operations in a helper process started with the
+// credential of the logged-in user, so that created files are owned by that
+// user while the server itself keeps a single identity.
+package privsep
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/driver"
+)
+
+const (
+	envHelper  = "FTP_SERVER_GO_PRIVSEP"
+	envAtomic  = "FTP_SERVER_GO_PRIVSEP_ATOMIC"
+	envSpawner = "FTP_SERVER_GO_PRIVSEP_SPAWNER"
+)
+
+const chunkSize = 64 * 1024
+
+// executable is the binary started as the helper and the spawner.
+var executable = os.Executable
+
+// Init runs the helper or the spawner and reports true when the process was
+// started by Start or NewSpawner. It must be called first in main, which
+// returns when it is true. The helpers started by the spawner inherit its
+// environment, so the helper is checked first.
+func Init() bool {
+	switch {
+	case os.Getenv(envHelper) == "1":
+		d := &driver.Driver{Atomic: os.Getenv(envAtomic) == "1"}
+		if err := Serve(d, os.Stdin, os.Stdout); err != nil {
+			log.Printf("privsep helper error: %v", err)
+		}
+	case os.Getenv(envSpawner) == "1":
+		conn, err := net.FileConn(os.NewFile(3, "privsep"))
+		if err != nil {
+			log.Printf("privsep spawner error: %v", err)
+			return true
+		}
+		if err := serveSpawner(conn.(*net.UnixConn)); err != nil {
+			log.Printf("privsep spawner error: %v", err)
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+func Serve(d *driver.Driver, reader io.Reader, writer io.Writer) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Manager", newService(d)); err != nil {
+		return err
+	}
+	server.ServeConn(&pipe{Reader: reader, Writer: writer})
+
+	return nil
+}
+
+type pipe struct {
+	io.Reader
+	io.Writer
+	closers []io.Closer
+}
+
+func (r *pipe) Close() error {
+	for _, v := range r.closers {
+		v.Close()
+	}
+	return nil
+}
+
+type PathArgs struct {
+	Path string
+}
+
+type OpenArgs struct {
+	Path   string
+	Offset int64
+}
+
+// CreateArgs opens a file for writing from Offset on, or at the end when
+// Append is set.
+type CreateArgs struct {
+	Path   string
+	Offset int64
+	Append bool
+}
+
+type ModeArgs struct {
+	Path string
+	Mode os.FileMode
+}
+
+type TimeArgs struct {
+	Path    string
+	ModTime time.Time
+}
+
+type RenameArgs struct {
+	Old string
+	New string
+}
+
+type ReadArgs struct {
+	Handle uint64
+	Size   int
+}
+
+type WriteArgs struct {
+	Handle uint64
+	Data   []byte
+}
+
+type service struct {
+	driver  *driver.Driver
+	mutex   sync.Mutex
+	readers map[uint64]io.ReadCloser
+	writers map[uint64]io.WriteCloser
+	next    uint64
+}
+
+func newService(d *driver.Driver) *service {
+	return &service{
+		driver:  d,
+		readers: make(map[uint64]io.ReadCloser),
+		writers: make(map[uint64]io.WriteCloser),
+	}
+}
+
+func (r *service) Stat(args PathArgs, reply *file.Attr) error {
+	info, err := r.driver.Stat(context.Background(), args.Path)
+	if err != nil {
+		return encodeError(err)
+	}
+	*reply = info.Attr()
+
+	return nil
+}
+
+func (r *service) List(args PathArgs, reply *[]file.Attr) error {
+	list, err := r.driver.List(context.Background(), args.Path)
+	if err != nil {
+		return encodeError(err)
+	}
+	for _, v := range list {
+		*reply = append(*reply, v.Attr())
+	}
+
+	return nil
+}
+
+func (r *service) Open(args OpenArgs, reply *uint64) error {
+	reader, err := r.driver.GetAt(context.Background(), args.Path, args.Offset)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.next++
+	r.readers[r.next] = reader
+	*reply = r.next
+
+	return nil
+}
+
+func (r *service) Create(args CreateArgs, reply *uint64) error {
+	var writer io.WriteCloser
+	var err error
+	if args.Append == true {
+		writer, err = r.driver.Append(context.Background(), args.Path)
+	} else {
+		writer, err = r.driver.PutAt(context.Background(), args.Path, args.Offset)
+	}
+	if err != nil {
+		return encodeError(err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.next++
+	r.writers[r.next] = writer
+	*reply = r.next
+
+	return nil
+}
+
+func (r *service) Read(args ReadArgs, reply *[]byte) error {
+	r.mutex.Lock()
+	reader, ok := r.readers[args.Handle]
+	r.mutex.Unlock()
+	if ok == false {
+		return encodeError(errors.New("invalid handle"))
+	}
+	if args.Size > chunkSize {
+		args.Size = chunkSize
+	}
+
+	buf := make([]byte, args.Size)
+	n, err := reader.Read(buf)
+	*reply = buf[:n]
+	if err == io.EOF && n > 0 {
+		return nil
+	}
+
+	return encodeError(err)
+}
+
+func (r *service) Write(args WriteArgs, reply *int) error {
+	r.mutex.Lock()
+	writer, ok := r.writers[args.Handle]
+	r.mutex.Unlock()
+	if ok == false {
+		return encodeError(errors.New("invalid handle"))
+	}
+
+	n, err := writer.Write(args.Data)
+	*reply = n
+
+	return encodeError(err)
+}
+
+func (r *service) Close(handle uint64, reply *struct{}) error {
+	r.mutex.Lock()
+	reader, okReader := r.readers[handle]
+	writer, okWriter := r.writers[handle]
+	delete(r.readers, handle)
+	delete(r.writers, handle)
+	r.mutex.Unlock()
+
+	if okReader == true {
+		return encodeError(reader.Close())
+	}
+	if okWriter == true {
+		return encodeError(writer.Close())
+	}
+	return encodeError(errors.New("invalid handle"))
+}
+
+func (r *service) Abort(handle uint64, reply *struct{}) error {
+	r.mutex.Lock()
+	writer, ok := r.writers[handle]
+	delete(r.writers, handle)
+	r.mutex.Unlock()
+
+	if ok == false {
+		return encodeError(errors.New("invalid handle"))
+	}
+	return encodeError(file.Abort(writer))
+}
+
+func (r *service) Remove(args PathArgs, reply *struct{}) error {
+	return encodeError(r.driver.Remove(context.Background(), args.Path))
+}
+
+func (r *service) Rename(args RenameArgs, reply *struct{}) error {
+	return encodeError(r.driver.Rename(context.Background(), args.Old, args.New))
+}
+
+func (r *service) Copy(args RenameArgs, reply *struct{}) error {
+	return encodeError(r.driver.Copy(context.Background(), args.Old, args.New))
+}
+
+func (r *service) Mkdir(args PathArgs, reply *struct{}) error {
+	return encodeError(r.driver.Mkdir(context.Background(), args.Path))
+}
+
+func (r *service) Chmod(args ModeArgs, reply *struct{}) error {
+	return encodeError(r.driver.Chmod(context.Background(), args.Path, args.Mode))
+}
+
+func (r *service) Symlink(args RenameArgs, reply *struct{}) error {
+	return encodeError(r.driver.Symlink(context.Background(), args.Old, args.New))
+}
+
+func (r *service) Chtimes(args TimeArgs, reply *struct{}) error {
+	return encodeError(r.driver.Chtimes(context.Background(), args.Path, args.ModTime))
+}
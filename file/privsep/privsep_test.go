@@ -0,0 +1,194 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package privsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/driver"
+	"github.com/donamKim/ftp-server-go/file/filetest"
+)
+
+// TestMain lets Start run the test binary as the helper.
+func TestMain(m *testing.M) {
+	if Init() == true {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestConformance(t *testing.T) {
+	filetest.Run(t, filetest.Backend{New: func(t *testing.T) (file.ManagerV2, string) {
+		dir, err := ioutil.TempDir("", "privsep")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		client, err := Start(nil, &driver.Driver{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client, dir
+	}})
+}
+
+func TestErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "privsep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := Start(nil, &driver.Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	missing := filepath.Join(dir, "missing")
+
+	if _, err := client.Stat(ctx, missing); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of Stat: %v", err)
+	}
+	if _, err := client.List(ctx, missing); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of List: %v", err)
+	}
+	if _, err := client.Get(ctx, missing); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of Get: %v", err)
+	}
+	if err := client.Remove(ctx, missing); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of Remove: %v", err)
+	}
+	err = client.Rename(ctx, missing, filepath.Join(dir, "g"))
+	if _, ok := err.(*os.LinkError); ok == false || os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of Rename: %v", err)
+	}
+	err = client.Mkdir(ctx, dir)
+	if v, ok := err.(*os.PathError); ok == false || os.IsExist(err) == false || v.Op != "mkdir" || v.Path != dir {
+		t.Fatalf("unexpected error of Mkdir: %#v", err)
+	}
+
+	reader, err := client.Get(ctx, filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	buf := make([]byte, 16)
+	if n, err := reader.Read(buf); n != 4 || err != nil {
+		t.Fatalf("unexpected read: n=%v, err=%v", n, err)
+	}
+	if _, err := reader.Read(buf); err != io.EOF {
+		t.Fatalf("unexpected error at the end: %v", err)
+	}
+}
+
+func TestRemoteError(t *testing.T) {
+	for _, v := range []error{io.EOF, file.ErrNotSupported, os.ErrExist, context.Canceled} {
+		if err := decodeError(rpcError(encodeError(v))); err != v {
+			t.Fatalf("unexpected error: %v, want %v", err, v)
+		}
+	}
+	if err := decodeError(rpcError(encodeError(&os.PathError{Op: "open", Path: "/f", Err: os.ErrPermission}))); os.IsPermission(err) == false {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// rpcError is the error of a reply as net/rpc returns it.
+func rpcError(err error) error {
+	return rpc.ServerError(err.Error())
+}
+
+func TestSpawner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the spawner needs root")
+	}
+	dir, err := ioutil.TempDir("", "privsep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The helper runs as nobody, which may not reach the test binary.
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "privsep.test")
+	if err := ioutil.WriteFile(binary, b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	executable = func() (string, error) { return binary, nil }
+	defer func() { executable = os.Executable }()
+
+	spawner, err := NewSpawner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spawner.Close()
+	if _, err := spawner.Start(&syscall.Credential{}, &driver.Driver{}); err == nil {
+		t.Fatal("started a helper as root")
+	}
+
+	credential := &syscall.Credential{Uid: 65534, Gid: 65534}
+	client, err := spawner.Start(credential, &driver.Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	p := filepath.Join(dir, "f")
+	w, err := client.Put(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := info.Sys().(*syscall.Stat_t).Uid; uid != credential.Uid {
+		t.Fatalf("unexpected owner: %v", uid)
+	}
+	if _, err := client.Stat(ctx, filepath.Join(dir, "missing")); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error of Stat: %v", err)
+	}
+}
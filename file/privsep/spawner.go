@@ -0,0 +1,229 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package privsep
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/donamKim/ftp-server-go/file/driver"
+)
+
+const maxMessage = 4096
+
+// Spawner starts the helpers from a small process which keeps the privilege
+// to switch identities, so the server itself can drop its privileges after
+// binding. The connection to a started helper is passed back over a unix
+// socket. It starts no helper as root.
+type Spawner struct {
+	mutex sync.Mutex
+	conn  *net.UnixConn
+	cmd   *exec.Cmd
+}
+
+type spawnRequest struct {
+	Credential syscall.Credential
+	Atomic     bool
+}
+
+type spawnReply struct {
+	Error string
+}
+
+// NewSpawner re-executes the running binary as the spawner, which runs until
+// the Spawner is closed or the server exits. It must be called before the
+// privileges are dropped.
+func NewSpawner() (*Spawner, error) {
+	local, remote, err := socketpair(syscall.SOCK_SEQPACKET)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+	defer local.Close()
+
+	path, err := executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), envSpawner+"=1")
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	return &Spawner{conn: conn.(*net.UnixConn), cmd: cmd}, nil
+}
+
+func socketpair(typ int) (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, typ|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+
+	return os.NewFile(uintptr(fds[0]), "privsep"), os.NewFile(uintptr(fds[1]), "privsep"), nil
+}
+
+// Start has the spawner start a helper as Start does.
+func (r *Spawner) Start(credential *syscall.Credential, d *driver.Driver) (*Client, error) {
+	if credential == nil || credential.Uid == 0 {
+		return nil, errors.New("privsep: no helper is started as root")
+	}
+	b, err := json.Marshal(&spawnRequest{Credential: *credential, Atomic: d.Atomic})
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.conn.Write(b); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessage)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := r.conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply spawnReply
+	if err := json.Unmarshal(buf[:n], &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Error) > 0 {
+		return nil, errors.New(reply.Error)
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) != 1 {
+		return nil, errors.New("privsep: no helper connection received")
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, errors.New("privsep: no helper connection received")
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "privsep")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(conn, nil), nil
+}
+
+// Close stops the spawner. The helpers started keep running until their
+// clients are closed.
+func (r *Spawner) Close() error {
+	r.conn.Close()
+	return r.cmd.Wait()
+}
+
+// serveSpawner answers the requests of the server until it closes the
+// connection.
+func serveSpawner(conn *net.UnixConn) error {
+	buf := make([]byte, maxMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil
+		}
+
+		var reply spawnReply
+		var rights []byte
+		f, err := spawn(buf[:n])
+		if err != nil {
+			reply.Error = fmt.Sprintf("failed to start helper: %v", err)
+		} else {
+			rights = syscall.UnixRights(int(f.Fd()))
+		}
+		b, err := json.Marshal(&reply)
+		if err != nil {
+			return err
+		}
+		_, _, err = conn.WriteMsgUnix(b, rights, nil)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spawn starts a helper on one end of a new socket pair and returns the
+// other end.
+func spawn(b []byte) (*os.File, error) {
+	var request spawnRequest
+	if err := json.Unmarshal(b, &request); err != nil {
+		return nil, err
+	}
+	if request.Credential.Uid == 0 {
+		return nil, errors.New("refused to start helper as root")
+	}
+
+	local, remote, err := socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+
+	cmd, err := helperCommand(&request.Credential, request.Atomic)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	cmd.Stdin = remote
+	cmd.Stdout = remote
+	if err := cmd.Start(); err != nil {
+		local.Close()
+		return nil, err
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("privsep helper exited: uid=%v, err=%v", request.Credential.Uid, err)
+		}
+	}()
+
+	return local, nil
+}
@@ -0,0 +1,258 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package quota
+
+import (
+	"context"
+	"io"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// Manager enforces the trees containing the paths written through it.
+type Manager struct {
+	file.Decorator
+	Trees []*Tree
+}
+
+func New(manager file.ManagerV2, trees ...*Tree) *Manager {
+	return &Manager{Decorator: file.Decorator{ManagerV2: manager}, Trees: trees}
+}
+
+func (r *Manager) trees(ctx context.Context, p string) ([]*Tree, error) {
+	trees := make([]*Tree, 0, len(r.Trees))
+	for _, v := range r.Trees {
+		if v.Contains(p) == false {
+			continue
+		}
+		if err := v.ensure(ctx, r.ManagerV2); err != nil {
+			return nil, err
+		}
+		trees = append(trees, v)
+	}
+
+	return trees, nil
+}
+
+func charge(trees []*Tree, delta Usage) error {
+	for i, v := range trees {
+		if err := v.charge(delta, true); err != nil {
+			for _, w := range trees[:i] {
+				w.charge(delta.neg(), false)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func force(trees []*Tree, delta Usage) {
+	for _, v := range trees {
+		v.charge(delta, false)
+	}
+}
+
+func (r *Manager) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	return r.create(ctx, p, 0, func() (io.WriteCloser, error) {
+		return r.ManagerV2.Put(ctx, p)
+	})
+}
+
+func (r *Manager) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	return r.create(ctx, p, offset, func() (io.WriteCloser, error) {
+		return file.PutAt(ctx, r.ManagerV2, p, offset)
+	})
+}
+
+func (r *Manager) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	return r.create(ctx, p, -1, func() (io.WriteCloser, error) {
+		return file.Append(ctx, r.ManagerV2, p)
+	})
+}
+
+// create reserves a new file and credits the bytes the write replaces up
+// front. The reservation is replaced by the real change of the file when
+// the writer finished.
+func (r *Manager) create(ctx context.Context, p string, offset int64, open func() (io.WriteCloser, error)) (io.WriteCloser, error) {
+	trees, err := r.trees(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(trees) == 0 {
+		return open()
+	}
+
+	before := r.usage(ctx, p)
+	kept := before.Bytes
+	if offset >= 0 && offset < kept {
+		kept = offset
+	}
+	reserved := Usage{Bytes: kept - before.Bytes, Files: 1 - before.Files}
+	if err := charge(trees, reserved); err != nil {
+		return nil, err
+	}
+
+	w, err := open()
+	if err != nil {
+		force(trees, reserved.neg())
+		return nil, err
+	}
+
+	return &writer{WriteCloser: w, manager: r, path: p, trees: trees, before: before, reserved: reserved}, nil
+}
+
+// usage of a single file, which is zero when it does not exist.
+func (r *Manager) usage(ctx context.Context, p string) Usage {
+	info, err := r.ManagerV2.Stat(ctx, p)
+	if err != nil || info.IsDir() == true {
+		return Usage{}
+	}
+
+	return Usage{Bytes: info.Size(), Files: 1}
+}
+
+func (r *Manager) Remove(ctx context.Context, p string) error {
+	trees, err := r.trees(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	before := r.usage(ctx, p)
+	if err := r.ManagerV2.Remove(ctx, p); err != nil {
+		return err
+	}
+	force(trees, before.neg())
+
+	return nil
+}
+
+// Rename charges the moved files to the trees containing only the new path,
+// and fails with ErrExceeded when they are full.
+func (r *Manager) Rename(ctx context.Context, old string, new string) error {
+	oldTrees, err := r.trees(ctx, old)
+	if err != nil {
+		return err
+	}
+	newTrees, err := r.trees(ctx, new)
+	if err != nil {
+		return err
+	}
+	added := difference(newTrees, oldTrees)
+	removed := difference(oldTrees, newTrees)
+
+	// The file replaced at the new path leaves the trees containing it.
+	var replaced Usage
+	if len(newTrees) > 0 {
+		replaced = r.usage(ctx, new)
+	}
+	var moved Usage
+	if len(added) > 0 || len(removed) > 0 {
+		if moved, err = Walk(ctx, r.ManagerV2, old); err != nil {
+			return err
+		}
+	}
+	if err := charge(added, moved); err != nil {
+		return err
+	}
+
+	if err := r.ManagerV2.Rename(ctx, old, new); err != nil {
+		force(added, moved.neg())
+		return err
+	}
+	force(removed, moved.neg())
+	force(newTrees, replaced.neg())
+
+	return nil
+}
+
+func difference(a []*Tree, b []*Tree) []*Tree {
+	list := make([]*Tree, 0, len(a))
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+type writer struct {
+	io.WriteCloser
+	manager  *Manager
+	path     string
+	trees    []*Tree
+	before   Usage
+	reserved Usage
+	done     bool
+}
+
+func (r *writer) Write(p []byte) (int, error) {
+	if err := charge(r.trees, Usage{Bytes: int64(len(p))}); err != nil {
+		return 0, err
+	}
+	r.reserved.Bytes += int64(len(p))
+
+	n, err := r.WriteCloser.Write(p)
+	if n < len(p) {
+		force(r.trees, Usage{Bytes: int64(n - len(p))})
+		r.reserved.Bytes -= int64(len(p) - n)
+	}
+
+	return n, err
+}
+
+func (r *writer) Close() error {
+	if r.done == true {
+		return nil
+	}
+	err := r.WriteCloser.Close()
+	r.finish()
+
+	return err
+}
+
+func (r *writer) Abort() error {
+	if r.done == true {
+		return nil
+	}
+	err := file.Abort(r.WriteCloser)
+	r.finish()
+
+	return err
+}
+
+// finish replaces the reservation with the change of the file, which also
+// covers backends that only commit on Close.
+func (r *writer) finish() {
+	r.done = true
+
+	after := r.manager.usage(context.Background(), r.path)
+	force(r.trees, r.reserved.neg())
+	force(r.trees, Usage{Bytes: after.Bytes - r.before.Bytes, Files: after.Files - r.before.Files})
+}
@@ -0,0 +1,190 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package quota limits the bytes and the number of files below directory
+// trees. Usage is scanned once per tree and then tracked incrementally by
+// Manager, which fails writes with ErrExceeded as soon as a limit is crossed.
+package quota
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+var ErrExceeded = errors.New("quota exceeded")
+
+// Limit of zero means unlimited.
+type Limit struct {
+	Bytes int64
+	Files int64
+}
+
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+func (r Usage) neg() Usage {
+	return Usage{Bytes: -r.Bytes, Files: -r.Files}
+}
+
+// Tree is shared by every session writing below Path.
+type Tree struct {
+	Path string
+
+	mutex   sync.Mutex
+	limit   Limit
+	usage   Usage
+	scanned bool
+
+	scanMutex sync.Mutex
+}
+
+func NewTree(path string, limit Limit) *Tree {
+	return &Tree{Path: filepath.Clean(path), limit: limit}
+}
+
+func (r *Tree) Limit() Limit {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.limit
+}
+
+func (r *Tree) SetLimit(limit Limit) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.limit = limit
+}
+
+func (r *Tree) Usage() Usage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.usage
+}
+
+func (r *Tree) Contains(p string) bool {
+	p = filepath.Clean(p)
+	if r.Path == string(filepath.Separator) {
+		return strings.HasPrefix(p, r.Path)
+	}
+
+	return p == r.Path || strings.HasPrefix(p, r.Path+string(filepath.Separator))
+}
+
+// Scan rebuilds the usage from the files below Path. Uploads in progress
+// are reconciled when they finish.
+func (r *Tree) Scan(ctx context.Context, m file.ManagerV2) error {
+	r.scanMutex.Lock()
+	defer r.scanMutex.Unlock()
+
+	return r.scan(ctx, m)
+}
+
+func (r *Tree) scan(ctx context.Context, m file.ManagerV2) error {
+	usage, err := Walk(ctx, m, r.Path)
+	// A tree whose directory is not created yet is empty.
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.usage = usage
+	r.scanned = true
+	return nil
+}
+
+func (r *Tree) ensure(ctx context.Context, m file.ManagerV2) error {
+	r.scanMutex.Lock()
+	defer r.scanMutex.Unlock()
+
+	r.mutex.Lock()
+	scanned := r.scanned
+	r.mutex.Unlock()
+	if scanned == true {
+		return nil
+	}
+
+	return r.scan(ctx, m)
+}
+
+// charge adds the delta to the usage. With check, an increase crossing the
+// limit fails with ErrExceeded and leaves the usage unchanged.
+func (r *Tree) charge(delta Usage, check bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if check == true {
+		if delta.Bytes > 0 && r.limit.Bytes > 0 && r.usage.Bytes+delta.Bytes > r.limit.Bytes {
+			return ErrExceeded
+		}
+		if delta.Files > 0 && r.limit.Files > 0 && r.usage.Files+delta.Files > r.limit.Files {
+			return ErrExceeded
+		}
+	}
+
+	r.usage.Bytes += delta.Bytes
+	r.usage.Files += delta.Files
+	return nil
+}
+
+// Walk sums the sizes and the number of the files below p, or of p itself
+// when it is a file.
+func Walk(ctx context.Context, m file.ManagerV2, p string) (Usage, error) {
+	info, err := m.Stat(ctx, p)
+	if err != nil {
+		return Usage{}, err
+	}
+	if info.IsDir() == false {
+		return Usage{Bytes: info.Size(), Files: 1}, nil
+	}
+
+	var usage Usage
+	list, err := m.List(ctx, p)
+	if err != nil {
+		return Usage{}, err
+	}
+	for _, v := range list {
+		if v.IsDir() == false {
+			usage.Bytes += v.Size()
+			usage.Files++
+			continue
+		}
+
+		sub, err := Walk(ctx, m, filepath.Join(p, v.Name()))
+		if err != nil {
+			return Usage{}, err
+		}
+		usage.Bytes += sub.Bytes
+		usage.Files += sub.Files
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,79 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package readonly serves a file.ManagerV2 without allowing any change.
+package readonly
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+type Manager struct {
+	file.Decorator
+}
+
+func New(manager file.ManagerV2) *Manager {
+	return &Manager{Decorator: file.Decorator{ManagerV2: manager}}
+}
+
+func denied(op string, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+}
+
+func (r *Manager) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	return nil, denied("create", p)
+}
+
+func (r *Manager) PutAt(ctx context.Context, p string, offset int64) (io.WriteCloser, error) {
+	return nil, denied("create", p)
+}
+
+func (r *Manager) Append(ctx context.Context, p string) (io.WriteCloser, error) {
+	return nil, denied("append", p)
+}
+
+func (r *Manager) Remove(ctx context.Context, p string) error {
+	return denied("remove", p)
+}
+
+func (r *Manager) Rename(ctx context.Context, old string, new string) error {
+	return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrPermission}
+}
+
+func (r *Manager) Mkdir(ctx context.Context, p string) error {
+	return denied("mkdir", p)
+}
+
+func (r *Manager) Chmod(ctx context.Context, p string, mode os.FileMode) error {
+	return denied("chmod", p)
+}
+
+func (r *Manager) Chtimes(ctx context.Context, p string, modTime time.Time) error {
+	return denied("chtimes", p)
+}
+
+func (r *Manager) Symlink(ctx context.Context, target string, p string) error {
+	return denied("symlink", p)
+}
@@ -0,0 +1,566 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package s3 implements a file.Manager over a bucket of an S3-compatible
+// object storage. Directories are emulated with key prefixes and zero-sized
+// marker objects whose key ends with a slash.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+const DefaultPartSize = 8 * 1024 * 1024
+
+// maxCopySize is the largest object copied by a single request.
+var maxCopySize int64 = 5 << 30
+
+type Bucket struct {
+	// Endpoint is the base URL of the service, like "https://s3.amazonaws.com"
+	// or "http://127.0.0.1:9000". The bucket is addressed in path style.
+	Endpoint  string
+	Region    string
+	Name      string
+	AccessKey string
+	SecretKey string
+
+	// Prefix is prepended to every key, so the FTP root can be a part of
+	// the bucket.
+	Prefix string
+
+	// PartSize is the size of the multipart upload parts, which are held in
+	// memory while uploading. S3 requires at least 5 MiB; DefaultPartSize is
+	// used when it is zero.
+	PartSize int
+
+	// Uid and Gid are reported as the owner of every object.
+	Uid uint32
+	Gid uint32
+
+	Client *http.Client
+}
+
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (r *Error) Error() string {
+	return fmt.Sprintf("s3: %v %v: %v", r.StatusCode, r.Code, r.Message)
+}
+
+func (r *Bucket) key(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	prefix := strings.Trim(r.Prefix, "/")
+	if len(prefix) == 0 {
+		return p
+	}
+	if len(p) == 0 {
+		return prefix
+	}
+
+	return prefix + "/" + p
+}
+
+// dirKey is the prefix of the objects in the directory, and the key of its
+// marker object.
+func (r *Bucket) dirKey(p string) string {
+	key := r.key(p)
+	if len(key) == 0 {
+		return ""
+	}
+
+	return key + "/"
+}
+
+func (r *Bucket) do(ctx context.Context, method string, key string, query map[string]string, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(r.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + r.Name + "/" + key
+	u.RawPath = "/" + escapePath(r.Name) + "/" + escapePath(key)
+	u.RawQuery = encodeQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		payloadHash = hashHex(body)
+	}
+	r.sign(req, payloadHash, time.Now())
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		v := &Error{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(resp.Body)
+		xml.Unmarshal(data, v)
+		return nil, v
+	}
+
+	return resp, nil
+}
+
+func (r *Bucket) call(ctx context.Context, method string, key string, query map[string]string, header http.Header, body []byte, v interface{}) error {
+	resp, err := r.do(ctx, method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+func isNotFound(err error) bool {
+	v, ok := err.(*Error)
+	return ok == true && v.StatusCode == http.StatusNotFound
+}
+
+func pathError(op string, p string, err error) error {
+	if isNotFound(err) == true {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+func (r *Bucket) fileInfo(name string, size int64, modTime time.Time) *file.Info {
+	return file.Attr{Name: name, Size: size, Mode: 0644, ModTime: modTime, Uid: r.Uid, Gid: r.Gid}.Info()
+}
+
+func (r *Bucket) dirInfo(name string, modTime time.Time) *file.Info {
+	return file.Attr{Name: name, Mode: os.ModeDir | 0755, ModTime: modTime, Uid: r.Uid, Gid: r.Gid}.Info()
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (r *Bucket) list(ctx context.Context, prefix string, delimiter string, maxKeys int, fn func(result *listResult) bool) error {
+	query := map[string]string{"list-type": "2", "prefix": prefix}
+	if len(delimiter) > 0 {
+		query["delimiter"] = delimiter
+	}
+	if maxKeys > 0 {
+		query["max-keys"] = strconv.Itoa(maxKeys)
+	}
+
+	for {
+		result := new(listResult)
+		if err := r.call(ctx, http.MethodGet, "", query, nil, nil, result); err != nil {
+			return err
+		}
+		if fn(result) == false || result.IsTruncated == false || len(result.NextContinuationToken) == 0 {
+			return nil
+		}
+		query["continuation-token"] = result.NextContinuationToken
+	}
+}
+
+// isDir reports whether any object, including a marker, has the directory
+// prefix.
+func (r *Bucket) isDir(ctx context.Context, p string) (bool, error) {
+	found := false
+	err := r.list(ctx, r.dirKey(p), "", 1, func(result *listResult) bool {
+		found = len(result.Contents) > 0
+		return false
+	})
+
+	return found, err
+}
+
+func (r *Bucket) Stat(ctx context.Context, p string) (*file.Info, error) {
+	name := path.Base(path.Clean("/" + p))
+	if len(r.key(p)) == 0 {
+		return r.dirInfo(name, time.Time{}), nil
+	}
+
+	resp, err := r.do(ctx, http.MethodHead, r.key(p), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return r.fileInfo(name, resp.ContentLength, modTime), nil
+	}
+	if isNotFound(err) == false {
+		return nil, pathError("stat", p, err)
+	}
+
+	ok, err := r.isDir(ctx, p)
+	if err != nil {
+		return nil, pathError("stat", p, err)
+	}
+	if ok == false {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+
+	return r.dirInfo(name, time.Time{}), nil
+}
+
+func (r *Bucket) List(ctx context.Context, p string) ([]*file.Info, error) {
+	info, err := r.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() == false {
+		return []*file.Info{}, nil
+	}
+
+	prefix := r.dirKey(p)
+	list := make([]*file.Info, 0)
+	err = r.list(ctx, prefix, "/", 0, func(result *listResult) bool {
+		for _, v := range result.CommonPrefixes {
+			list = append(list, r.dirInfo(path.Base(v.Prefix), time.Time{}))
+		}
+		for _, v := range result.Contents {
+			if v.Key == prefix {
+				continue
+			}
+			list = append(list, r.fileInfo(path.Base(v.Key), v.Size, v.LastModified))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, pathError("list", p, err)
+	}
+
+	return list, nil
+}
+
+func (r *Bucket) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	return r.GetAt(ctx, p, 0)
+}
+
+func (r *Bucket) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := r.do(ctx, http.MethodGet, r.key(p), nil, header, nil)
+	if err != nil {
+		return nil, pathError("open", p, err)
+	}
+
+	return resp.Body, nil
+}
+
+// Put uploads small files with a single request and larger ones with a
+// multipart upload, holding a single part in memory at a time. The object
+// appears when the writer was closed.
+func (r *Bucket) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	return file.NewPipeWriter(func(reader io.Reader) error {
+		return r.upload(ctx, p, reader)
+	}), nil
+}
+
+func (r *Bucket) upload(ctx context.Context, p string, reader io.Reader) error {
+	size := r.PartSize
+	if size <= 0 {
+		size = DefaultPartSize
+	}
+
+	buf := make([]byte, size)
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if err := r.call(ctx, http.MethodPut, r.key(p), nil, nil, buf[:n], nil); err != nil {
+			return pathError("create", p, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := r.putMultipart(ctx, r.key(p), buf, reader); err != nil {
+		return pathError("create", p, err)
+	}
+	return nil
+}
+
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (r *Bucket) putMultipart(ctx context.Context, key string, buf []byte, reader io.Reader) error {
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := r.call(ctx, http.MethodPost, key, map[string]string{"uploads": ""}, nil, nil, &initiate); err != nil {
+		return err
+	}
+
+	complete := completeUpload{}
+	part, last := buf, false
+	for number := 1; ; number++ {
+		resp, err := r.do(ctx, http.MethodPut, key, map[string]string{
+			"partNumber": strconv.Itoa(number),
+			"uploadId":   initiate.UploadID,
+		}, nil, part)
+		if err != nil {
+			r.abortMultipart(key, initiate.UploadID)
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		if last == true {
+			break
+		}
+
+		n, err := io.ReadFull(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			r.abortMultipart(key, initiate.UploadID)
+			return err
+		}
+		part = buf[:n]
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	return r.call(ctx, http.MethodPost, key, map[string]string{"uploadId": initiate.UploadID}, nil, body, nil)
+}
+
+// abortMultipart runs without the context of the upload, which may have been
+// canceled.
+func (r *Bucket) abortMultipart(key string, uploadID string) {
+	if err := r.call(context.Background(), http.MethodDelete, key, map[string]string{"uploadId": uploadID}, nil, nil, nil); err != nil {
+		log.Printf("failed to abort multipart upload: key=%v, err=%v", key, err)
+	}
+}
+
+func (r *Bucket) Remove(ctx context.Context, p string) error {
+	info, err := r.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() == false {
+		if err := r.call(ctx, http.MethodDelete, r.key(p), nil, nil, nil, nil); err != nil {
+			return pathError("remove", p, err)
+		}
+		return nil
+	}
+
+	prefix := r.dirKey(p)
+	if len(prefix) == 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.EBUSY}
+	}
+	empty := true
+	err = r.list(ctx, prefix, "", 2, func(result *listResult) bool {
+		for _, v := range result.Contents {
+			if v.Key != prefix {
+				empty = false
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return pathError("remove", p, err)
+	}
+	if empty == false {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+	}
+	if err := r.call(ctx, http.MethodDelete, prefix, nil, nil, nil, nil); err != nil {
+		return pathError("remove", p, err)
+	}
+
+	return nil
+}
+
+// Rename copies every object on the server side and deletes the originals,
+// since object storages have no rename.
+func (r *Bucket) Rename(ctx context.Context, old string, new string) error {
+	info, err := r.Stat(ctx, old)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() == false {
+		return r.move(ctx, r.key(old), r.key(new), info.Size())
+	}
+
+	oldPrefix, newPrefix := r.dirKey(old), r.dirKey(new)
+	if len(oldPrefix) == 0 || strings.HasPrefix(newPrefix, oldPrefix) == true {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: syscall.EINVAL}
+	}
+	sizes := make(map[string]int64)
+	err = r.list(ctx, oldPrefix, "", 0, func(result *listResult) bool {
+		for _, v := range result.Contents {
+			sizes[v.Key] = v.Size
+		}
+		return true
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: err}
+	}
+	for k, v := range sizes {
+		if err := r.move(ctx, k, newPrefix+strings.TrimPrefix(k, oldPrefix), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Bucket) move(ctx context.Context, old string, new string, size int64) error {
+	if err := r.copyObject(ctx, old, new, size); err != nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: err}
+	}
+	if err := r.call(ctx, http.MethodDelete, old, nil, nil, nil, nil); err != nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: err}
+	}
+
+	return nil
+}
+
+// copyObject copies the objects up to maxCopySize with a single request, which
+// is the limit of S3, and larger ones with a multipart upload copying parts
+// of that size.
+func (r *Bucket) copyObject(ctx context.Context, src string, dst string, size int64) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+escapePath(r.Name)+"/"+escapePath(src))
+	if size <= maxCopySize {
+		return r.call(ctx, http.MethodPut, dst, nil, header, nil, nil)
+	}
+
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := r.call(ctx, http.MethodPost, dst, map[string]string{"uploads": ""}, nil, nil, &initiate); err != nil {
+		return err
+	}
+
+	complete := completeUpload{}
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+maxCopySize, number+1 {
+		end := offset + maxCopySize
+		if end > size {
+			end = size
+		}
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		err := r.call(ctx, http.MethodPut, dst, map[string]string{
+			"partNumber": strconv.Itoa(number),
+			"uploadId":   initiate.UploadID,
+		}, header, nil, &result)
+		if err != nil {
+			r.abortMultipart(dst, initiate.UploadID)
+			return err
+		}
+		complete.Parts = append(complete.Parts, completePart{PartNumber: number, ETag: result.ETag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	return r.call(ctx, http.MethodPost, dst, map[string]string{"uploadId": initiate.UploadID}, nil, body, nil)
+}
+
+// Copy copies the object on the server side.
+func (r *Bucket) Copy(ctx context.Context, src string, dst string) error {
+	info, err := r.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() == true {
+		return &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	}
+	if err := r.copyObject(ctx, r.key(src), r.key(dst), info.Size()); err != nil {
+		return &os.LinkError{Op: "copy", Old: src, New: dst, Err: err}
+	}
+
+	return nil
+}
+
+// Mkdir creates the marker object of the directory.
+func (r *Bucket) Mkdir(ctx context.Context, p string) error {
+	prefix := r.dirKey(p)
+	if len(prefix) == 0 {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+	if _, err := r.Stat(ctx, p); err == nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	} else if os.IsNotExist(err) == false {
+		return err
+	}
+	if err := r.call(ctx, http.MethodPut, prefix, nil, nil, nil, nil); err != nil {
+		return pathError("mkdir", p, err)
+	}
+
+	return nil
+}
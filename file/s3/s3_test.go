@@ -0,0 +1,201 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/filetest"
+	"github.com/donamKim/ftp-server-go/file/s3/s3test"
+)
+
+func newBucket(t *testing.T) (*Bucket, *s3test.Server) {
+	server := s3test.New("access", "secret", "bucket")
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return &Bucket{Endpoint: ts.URL, Region: "us-east-1", Name: "bucket", AccessKey: "access", SecretKey: "secret", Prefix: "root"}, server
+}
+
+func TestConformance(t *testing.T) {
+	filetest.Run(t, filetest.Backend{New: func(t *testing.T) (file.ManagerV2, string) {
+		bucket, _ := newBucket(t)
+		return bucket, "/"
+	}, ImplicitDirs: true})
+}
+
+func TestSignature(t *testing.T) {
+	bucket, server := newBucket(t)
+	filetest.Put(t, bucket, "/a b+c=d%.txt", "data")
+	if v := filetest.Read(t, bucket, "/a b+c=d%.txt", 0); v != "data" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+
+	bucket.SecretKey = "wrong"
+	w, err := bucket.Put(context.Background(), "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "data")
+	if err := w.Close(); err == nil || strings.Contains(err.Error(), "SignatureDoesNotMatch") == false {
+		t.Fatalf("wrong signature was accepted: %v", err)
+	}
+	if keys := server.Keys("bucket"); reflect.DeepEqual(keys, []string{"root/a b+c=d%.txt"}) == false {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+func TestMultipartPut(t *testing.T) {
+	bucket, server := newBucket(t)
+	bucket.PartSize = 16
+	data := strings.Repeat("0123456789", 5)
+	filetest.Put(t, bucket, "/big", data)
+	if v := filetest.Read(t, bucket, "/big", 0); v != data {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	filetest.Put(t, bucket, "/exact", data[:32])
+	if v := filetest.Read(t, bucket, "/exact", 0); v != data[:32] {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	if keys := server.Keys("bucket"); reflect.DeepEqual(keys, []string{"root/big", "root/exact"}) == false {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+func TestRangedGet(t *testing.T) {
+	bucket, _ := newBucket(t)
+	filetest.Put(t, bucket, "/f", "hello world")
+	if v := filetest.Read(t, bucket, "/f", 6); v != "world" {
+		t.Fatalf("unexpected data at offset: %q", v)
+	}
+	if v := filetest.Read(t, bucket, "/f", 11); v != "" {
+		t.Fatalf("unexpected data at the end: %q", v)
+	}
+	if _, err := bucket.GetAt(context.Background(), "/f", 12); err == nil {
+		t.Fatal("read beyond the end")
+	}
+	if _, err := bucket.Get(context.Background(), "/missing"); os.IsNotExist(err) == false {
+		t.Fatalf("unexpected error for a missing file: %v", err)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	bucket, _ := newBucket(t)
+	ctx := context.Background()
+	if err := bucket.Mkdir(ctx, "/empty"); err != nil {
+		t.Fatal(err)
+	}
+	filetest.Put(t, bucket, "/d/sub/f", "data")
+	filetest.Put(t, bucket, "/d/g", "data")
+
+	info, err := bucket.Stat(ctx, "/d")
+	if err != nil || info.IsDir() == false {
+		t.Fatalf("prefix is not a directory: %v, err=%v", info, err)
+	}
+	if v := filetest.Names(t, bucket, "/"); reflect.DeepEqual(v, []string{"d/", "empty/"}) == false {
+		t.Fatalf("unexpected list: %v", v)
+	}
+	if v := filetest.Names(t, bucket, "/d"); reflect.DeepEqual(v, []string{"sub/", "g"}) == false {
+		t.Fatalf("unexpected list: %v", v)
+	}
+	if v := filetest.Names(t, bucket, "/empty"); len(v) != 0 {
+		t.Fatalf("unexpected list: %v", v)
+	}
+	if v := filetest.Names(t, bucket, "/d/g"); len(v) != 0 {
+		t.Fatalf("unexpected list of a file: %v", v)
+	}
+	if err := bucket.Remove(ctx, "/d"); err == nil {
+		t.Fatal("removed a directory which is not empty")
+	}
+	if err := bucket.Remove(ctx, "/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Stat(ctx, "/empty"); os.IsNotExist(err) == false {
+		t.Fatalf("removed directory still exists: %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	bucket, server := newBucket(t)
+	ctx := context.Background()
+	filetest.Put(t, bucket, "/f", "file")
+	filetest.Put(t, bucket, "/d/sub/g", "nested")
+	if err := bucket.Mkdir(ctx, "/d/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bucket.Rename(ctx, "/f", "/d/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Rename(ctx, "/d", "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Rename(ctx, "/e", "/e/inside"); err == nil {
+		t.Fatal("renamed a directory into itself")
+	}
+	if v := filetest.Read(t, bucket, "/e/f", 0); v != "file" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	if v := filetest.Read(t, bucket, "/e/sub/g", 0); v != "nested" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	want := []string{"root/e/empty/", "root/e/f", "root/e/sub/g"}
+	if keys := server.Keys("bucket"); reflect.DeepEqual(keys, want) == false {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if _, err := bucket.Stat(ctx, "/d"); os.IsNotExist(err) == false {
+		t.Fatalf("renamed directory still exists: %v", err)
+	}
+}
+
+func TestLargeCopy(t *testing.T) {
+	bucket, server := newBucket(t)
+	server.MaxCopySize = 16
+	maxCopySize = 16
+	defer func() { maxCopySize = 5 << 30 }()
+
+	ctx := context.Background()
+	data := strings.Repeat("0123456789", 5)
+	filetest.Put(t, bucket, "/f", data)
+	if err := bucket.Copy(ctx, "/f", "/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Rename(ctx, "/g", "/d/h"); err != nil {
+		t.Fatal(err)
+	}
+	if v := filetest.Read(t, bucket, "/d/h", 0); v != data {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	filetest.Put(t, bucket, "/small", "small")
+	if err := bucket.Copy(ctx, "/small", "/small2"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys("bucket"); reflect.DeepEqual(keys, []string{"root/d/h", "root/f", "root/small", "root/small2"}) == false {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
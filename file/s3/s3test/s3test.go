@@ -0,0 +1,507 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package s3test provides an in-memory stand-in for an S3-compatible
+// service, covering what the s3 package uses. Serve it with
+// httptest.NewServer to test without a real object storage. Requests with a
+// wrong signature are refused as by the real service.
+package s3test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server verifies the AWS Signature Version 4 of every request against
+// AccessKey and SecretKey, in the region of the credential scope.
+type Server struct {
+	AccessKey string
+	SecretKey string
+
+	// MaxCopySize refuses to copy larger objects with a single request, as
+	// S3 does above 5 GiB. Zero is unlimited.
+	MaxCopySize int
+
+	mutex   sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	next    int
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+	etag    string
+}
+
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int]*object
+}
+
+func New(accessKey string, secretKey string, buckets ...string) *Server {
+	v := &Server{AccessKey: accessKey, SecretKey: secretKey, buckets: make(map[string]map[string]*object), uploads: make(map[string]*upload)}
+	for _, name := range buckets {
+		v.buckets[name] = make(map[string]*object)
+	}
+
+	return v
+}
+
+// Keys returns the sorted keys of the bucket.
+func (r *Server) Keys(bucket string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]string, 0)
+	for k := range r.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{data: data, modTime: time.Now().UTC(), etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+}
+
+func (r *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := r.verify(req, body); err != nil {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	s := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	name, key := s[0], ""
+	if len(s) == 2 {
+		key = s[1]
+	}
+	query := req.URL.Query()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bucket, ok := r.buckets[name]
+	if ok == false {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", name)
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodGet && len(key) == 0:
+		r.list(w, bucket, query)
+	case req.Method == http.MethodGet, req.Method == http.MethodHead:
+		r.get(w, req, bucket, key)
+	case req.Method == http.MethodPut && len(query.Get("uploadId")) > 0:
+		r.uploadPart(w, req, query, body)
+	case req.Method == http.MethodPut && len(req.Header.Get("X-Amz-Copy-Source")) > 0:
+		r.copy(w, req, bucket, key)
+	case req.Method == http.MethodPut:
+		bucket[key] = newObject(body)
+		w.Header().Set("ETag", bucket[key].etag)
+	case req.Method == http.MethodPost && hasKey(query, "uploads"):
+		r.next++
+		id := strconv.Itoa(r.next)
+		r.uploads[id] = &upload{bucket: name, key: key, parts: make(map[int]*object)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: name, Key: key, UploadId: id})
+	case req.Method == http.MethodPost && len(query.Get("uploadId")) > 0:
+		r.complete(w, query, body)
+	case req.Method == http.MethodDelete && len(query.Get("uploadId")) > 0:
+		delete(r.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", req.Method)
+	}
+}
+
+// verify computes the signature of the request on its own, from the path,
+// the query and the signed headers as received.
+func (r *Server) verify(req *http.Request, body []byte) error {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") == false {
+		return errors.New("missing signature")
+	}
+	fields := make(map[string]string)
+	for _, v := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != r.AccessKey || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return fmt.Errorf("invalid credential: %v", fields["Credential"])
+	}
+	date, region := credential[1], credential[2]
+	timestamp := req.Header.Get("X-Amz-Date")
+	if strings.HasPrefix(timestamp, date) == false {
+		return fmt.Errorf("date does not match the scope: %v", timestamp)
+	}
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return errors.New("payload hash does not match the body")
+	}
+
+	var headers strings.Builder
+	hostSigned := false
+	for _, v := range strings.Split(fields["SignedHeaders"], ";") {
+		value := req.Header.Get(v)
+		if v == "host" {
+			value, hostSigned = req.Host, true
+		}
+		headers.WriteString(v + ":" + strings.TrimSpace(value) + "\n")
+	}
+	if hostSigned == false {
+		return errors.New("host is not signed")
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, uriEncode(k, false)+"="+uriEncode(query.Get(k), false))
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, true),
+		strings.Join(pairs, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	scope := strings.Join(credential[1:], "/")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + r.SecretKey)
+	for _, v := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if hmac.Equal([]byte(expected), []byte(fields["Signature"])) == false {
+		return errors.New("signature does not match")
+	}
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode is the URI encoding of SigV4, which leaves only the unreserved
+// characters of RFC 3986.
+func uriEncode(s string, path bool) string {
+	var buf strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-_.~", c) >= 0 || (path == true && c == '/') {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+
+	return buf.String()
+}
+
+func (r *Server) list(w http.ResponseWriter, bucket map[string]*object, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil || maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	keys := make([]string, 0)
+	for k := range bucket {
+		if strings.HasPrefix(k, prefix) == true && k > query.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+		ETag         string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{Prefix: prefix}
+
+	seen := make(map[string]bool)
+	count := 0
+	for _, k := range keys {
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, delimiter); len(delimiter) > 0 && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if seen[p] == false {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+				count++
+			}
+		} else {
+			v := bucket[k]
+			result.Contents = append(result.Contents, content{
+				Key:          k,
+				Size:         len(v.data),
+				LastModified: v.modTime.Format(time.RFC3339),
+				ETag:         v.etag,
+			})
+			count++
+		}
+		result.NextContinuationToken = k
+		if len(delimiter) > 0 && len(result.CommonPrefixes) > 0 {
+			// Skip the rest of a common prefix at once.
+			last := result.CommonPrefixes[len(result.CommonPrefixes)-1].Prefix
+			if strings.HasPrefix(k, last) == true {
+				result.NextContinuationToken = last + "\xff"
+			}
+		}
+	}
+	if result.IsTruncated == false {
+		result.NextContinuationToken = ""
+	}
+
+	writeXML(w, result)
+}
+
+func (r *Server) get(w http.ResponseWriter, req *http.Request, bucket map[string]*object, key string) {
+	v, ok := bucket[key]
+	if ok == false {
+		writeError(w, http.StatusNotFound, "NoSuchKey", key)
+		return
+	}
+
+	data, status := v.data, http.StatusOK
+	if s := req.Header.Get("Range"); strings.HasPrefix(s, "bytes=") == true && strings.HasSuffix(s, "-") == true {
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(s, "bytes="), "-"))
+		if err != nil || offset > len(data) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", s)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+		data, status = data[offset:], http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", v.modTime.Format(http.TimeFormat))
+	w.Header().Set("ETag", v.etag)
+	w.WriteHeader(status)
+	if req.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// source returns the object named by the copy source header, limited to the
+// range of the part when it is set.
+func (r *Server) source(req *http.Request) ([]byte, error) {
+	name, err := url.PathUnescape(req.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil, err
+	}
+	s := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	if len(s) != 2 || r.buckets[s[0]] == nil || r.buckets[s[0]][s[1]] == nil {
+		return nil, os.ErrNotExist
+	}
+	data := r.buckets[s[0]][s[1]].data
+
+	v := req.Header.Get("X-Amz-Copy-Source-Range")
+	if len(v) == 0 {
+		return data, nil
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(v, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(data) {
+		return nil, errors.New("invalid copy source range")
+	}
+
+	return data[start : end+1], nil
+}
+
+func (r *Server) copy(w http.ResponseWriter, req *http.Request, bucket map[string]*object, key string) {
+	data, err := r.source(req)
+	if os.IsNotExist(err) == true {
+		writeError(w, http.StatusNotFound, "NoSuchKey", req.Header.Get("X-Amz-Copy-Source"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	if r.MaxCopySize > 0 && len(data) > r.MaxCopySize {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "The specified copy source is larger than the maximum allowable size")
+		return
+	}
+
+	v := newObject(data)
+	bucket[key] = v
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: v.etag, LastModified: v.modTime.Format(time.RFC3339)})
+}
+
+// uploadPart stores a part of the body, or copied with UploadPartCopy.
+func (r *Server) uploadPart(w http.ResponseWriter, req *http.Request, query url.Values, body []byte) {
+	v, ok := r.uploads[query.Get("uploadId")]
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if ok == false || err != nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", query.Get("uploadId"))
+		return
+	}
+	if len(req.Header.Get("X-Amz-Copy-Source")) == 0 {
+		v.parts[number] = newObject(body)
+		w.Header().Set("ETag", v.parts[number].etag)
+		return
+	}
+
+	data, err := r.source(req)
+	if os.IsNotExist(err) == true {
+		writeError(w, http.StatusNotFound, "NoSuchKey", req.Header.Get("X-Amz-Copy-Source"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	v.parts[number] = newObject(data)
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified string
+	}{ETag: v.parts[number].etag, LastModified: v.parts[number].modTime.Format(time.RFC3339)})
+}
+
+func (r *Server) complete(w http.ResponseWriter, query url.Values, body []byte) {
+	v, ok := r.uploads[query.Get("uploadId")]
+	if ok == false {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", query.Get("uploadId"))
+		return
+	}
+
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, p := range request.Parts {
+		part, ok := v.parts[p.PartNumber]
+		if ok == false || part.etag != p.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(p.PartNumber))
+			return
+		}
+		buf.Write(part.data)
+	}
+	r.buckets[v.bucket][v.key] = newObject(buf.Bytes())
+	delete(r.uploads, query.Get("uploadId"))
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+		ETag    string
+	}{Key: v.key, ETag: r.buckets[v.bucket][v.key].etag})
+}
+
+func hasKey(query url.Values, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+	w.Write(data)
+}
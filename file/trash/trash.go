@@ -0,0 +1,283 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package trash moves removed files to a trash directory instead of deleting
+// them, so they can be restored until the retention period passed.
+package trash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// purgeInterval limits how often PurgeExpired looks for expired entries.
+const purgeInterval = time.Hour
+
+var ErrNotFound = errors.New("not found in trash")
+
+// Entry is a removed file or empty directory. It is kept at its original
+// path below a directory of the trash named by the removal time, so no
+// metadata has to be written next to it.
+type Entry struct {
+	ID      string
+	Path    string
+	Deleted time.Time
+}
+
+// Manager keeps the removed files in Dir, which is hidden from List, and
+// removes them for good after Retention, or never when it is zero. Schedule
+// is shared by the managers created for the sessions of the same users.
+type Manager struct {
+	file.Decorator
+	Dir       string
+	Retention time.Duration
+	Schedule  *Schedule
+}
+
+// New refuses a relative dir, which would be resolved against the working
+// directory of the server.
+func New(manager file.ManagerV2, dir string, retention time.Duration) (*Manager, error) {
+	if filepath.IsAbs(dir) == false {
+		return nil, fmt.Errorf("trash directory is not absolute: dir=%v", dir)
+	}
+	return &Manager{
+		Decorator: file.Decorator{ManagerV2: manager},
+		Dir:       filepath.Clean(dir),
+		Retention: retention,
+		Schedule:  new(Schedule),
+	}, nil
+}
+
+// Schedule remembers when the trash directories were purged. The zero value
+// is ready to use.
+type Schedule struct {
+	mutex sync.Mutex
+	last  map[string]time.Time
+}
+
+// due reports whether dir was not purged within purgeInterval, and counts it
+// as purged from now on when so.
+func (r *Schedule) due(dir string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.last[dir]) < purgeInterval {
+		return false
+	}
+	if r.last == nil {
+		r.last = make(map[string]time.Time)
+	}
+	r.last[dir] = time.Now()
+
+	return true
+}
+
+func (r *Manager) inTrash(p string) bool {
+	p = filepath.Clean(p)
+	return p == r.Dir || strings.HasPrefix(p, r.Dir+string(filepath.Separator))
+}
+
+func (r *Manager) List(ctx context.Context, p string) ([]*file.Info, error) {
+	list, err := r.ManagerV2.List(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]*file.Info, 0, len(list))
+	for _, v := range list {
+		if filepath.Join(p, v.Name()) != r.Dir {
+			visible = append(visible, v)
+		}
+	}
+	return visible, nil
+}
+
+// Remove moves the file to the trash. Files inside the trash are removed for
+// good, and directories must be empty as for any Remove.
+func (r *Manager) Remove(ctx context.Context, p string) error {
+	if r.inTrash(p) == true {
+		return r.ManagerV2.Remove(ctx, p)
+	}
+	r.PurgeExpired(ctx)
+
+	p = filepath.Clean(p)
+	info, err := r.ManagerV2.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() == true {
+		list, err := r.ManagerV2.List(ctx, p)
+		if err != nil {
+			return err
+		}
+		if len(list) > 0 {
+			return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	dst := filepath.Join(r.Dir, id, p)
+	if err := file.MkdirAll(ctx, r.ManagerV2, filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := r.ManagerV2.Rename(ctx, p, dst); err != nil {
+		file.RemoveAll(ctx, r.ManagerV2, filepath.Join(r.Dir, id))
+		return err
+	}
+
+	return nil
+}
+
+// Entries returns the entries of the trash, latest first.
+func (r *Manager) Entries(ctx context.Context) ([]*Entry, error) {
+	list, err := r.ManagerV2.List(ctx, r.Dir)
+	if os.IsNotExist(err) == true {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, 0, len(list))
+	for _, v := range list {
+		nanos, err := strconv.ParseInt(v.Name(), 10, 64)
+		if err != nil || v.IsDir() == false {
+			continue
+		}
+		p, err := r.find(ctx, filepath.Join(r.Dir, v.Name()))
+		if err != nil {
+			log.Printf("failed to read trash entry: id=%v, err=%v", v.Name(), err)
+			continue
+		}
+		if len(p) == 0 {
+			continue
+		}
+		entries = append(entries, &Entry{ID: v.Name(), Path: p, Deleted: time.Unix(0, nanos)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+
+	return entries, nil
+}
+
+// find follows the directories leading to the removed file, each of which
+// has a single child. It ends at the file or at the removed directory, which
+// was empty. An empty result is an entry without a file.
+func (r *Manager) find(ctx context.Context, base string) (string, error) {
+	p := base
+	for {
+		list, err := r.ManagerV2.List(ctx, p)
+		if err != nil {
+			return "", err
+		}
+		if len(list) != 1 {
+			break
+		}
+		p = filepath.Join(p, list[0].Name())
+		if list[0].IsDir() == false {
+			break
+		}
+	}
+	if p == base {
+		return "", nil
+	}
+
+	return strings.TrimPrefix(p, base), nil
+}
+
+// Restore moves the latest entry removed from p back to p, which must not
+// exist.
+func (r *Manager) Restore(ctx context.Context, p string) error {
+	p = filepath.Clean(p)
+	entries, err := r.Entries(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range entries {
+		if v.Path != p {
+			continue
+		}
+		if _, err := r.ManagerV2.Stat(ctx, p); err == nil {
+			return &os.PathError{Op: "restore", Path: p, Err: os.ErrExist}
+		}
+		if err := r.ManagerV2.Rename(ctx, filepath.Join(r.Dir, v.ID, p), p); err != nil {
+			return err
+		}
+		return file.RemoveAll(ctx, r.ManagerV2, filepath.Join(r.Dir, v.ID))
+	}
+
+	return &os.PathError{Op: "restore", Path: p, Err: ErrNotFound}
+}
+
+// Purge removes the entries older than the retention for good.
+func (r *Manager) Purge(ctx context.Context) error {
+	if r.Retention <= 0 {
+		return nil
+	}
+	list, err := r.ManagerV2.List(ctx, r.Dir)
+	if os.IsNotExist(err) == true {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(-r.Retention)
+	for _, v := range list {
+		nanos, err := strconv.ParseInt(v.Name(), 10, 64)
+		if err != nil || time.Unix(0, nanos).After(deadline) == true {
+			continue
+		}
+		if err := file.RemoveAll(ctx, r.ManagerV2, filepath.Join(r.Dir, v.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PurgeExpired starts Purge in the background at most once per purgeInterval
+// and Dir. It is called at the login and by Remove, for the sessions running
+// for long, and stops when the context is done.
+func (r *Manager) PurgeExpired(ctx context.Context) {
+	if r.Retention <= 0 || r.Schedule.due(r.Dir) == false {
+		return
+	}
+
+	go func() {
+		if err := r.Purge(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("failed to purge trash: dir=%v, err=%v", r.Dir, err)
+		}
+	}()
+}
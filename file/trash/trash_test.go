@@ -0,0 +1,73 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package trash
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file/memory"
+)
+
+// purged waits for the background purge to remove the entry.
+func purged(fs *memory.FS, p string) bool {
+	for i := 0; i < 100; i++ {
+		if _, err := fs.Stat(context.Background(), p); os.IsNotExist(err) == true {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPurgeSchedule(t *testing.T) {
+	fs := memory.New()
+	schedule := new(Schedule)
+	newManager := func() *Manager {
+		m, err := New(fs, "/trash", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Schedule = schedule
+		return m
+	}
+
+	fs.MkdirAll("/trash/1000/a")
+	newManager().PurgeExpired(context.Background())
+	if purged(fs, "/trash/1000") == false {
+		t.Fatal("expired entry was kept")
+	}
+
+	// Another session of the user does not purge again.
+	fs.MkdirAll("/trash/2000/a")
+	newManager().PurgeExpired(context.Background())
+	if purged(fs, "/trash/2000") == true {
+		t.Fatal("purged again within the interval")
+	}
+
+	schedule = new(Schedule)
+	newManager().PurgeExpired(context.Background())
+	if purged(fs, "/trash/2000") == false {
+		t.Fatal("expired entry was kept")
+	}
+}
@@ -0,0 +1,359 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package version keeps the previous contents of overwritten files in a
+// hidden version store, and serves them at "path;N".
+package version
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// Version is a replaced content of a file. Replaced is when it was replaced,
+// which MaxAge is counted from.
+type Version struct {
+	Number   int
+	Size     int64
+	ModTime  time.Time
+	Replaced time.Time
+
+	name string
+}
+
+// Manager moves a file to Dir when it is replaced by Put or Rename. An upload
+// is written next to the versions first, so the file stays in place until the
+// upload is complete. The versions of a path are numbered from 1 on, and the
+// latest Keep of them replaced within MaxAge are kept, where zero is
+// unlimited. Resumed and appended uploads change the file in place.
+type Manager struct {
+	file.Decorator
+	Dir    string
+	Keep   int
+	MaxAge time.Duration
+}
+
+func New(manager file.ManagerV2, dir string, keep int, maxAge time.Duration) *Manager {
+	return &Manager{Decorator: file.Decorator{ManagerV2: manager}, Dir: filepath.Clean(dir), Keep: keep, MaxAge: maxAge}
+}
+
+func (r *Manager) inStore(p string) bool {
+	p = filepath.Clean(p)
+	return p == r.Dir || strings.HasPrefix(p, r.Dir+string(filepath.Separator))
+}
+
+// store is the directory holding the versions of p.
+func (r *Manager) store(p string) string {
+	return filepath.Join(r.Dir, filepath.Clean(p))
+}
+
+// split separates the version of a "path;N".
+func split(p string) (string, int, bool) {
+	i := strings.LastIndex(p, ";")
+	if i < 0 {
+		return p, 0, false
+	}
+	n, err := strconv.Atoi(p[i+1:])
+	if err != nil || n <= 0 {
+		return p, 0, false
+	}
+
+	return p[:i], n, true
+}
+
+// parse reads the name of a version, "N.T" with the time it was replaced in
+// Unix seconds. The time of a plain "N" is its modification time.
+func parse(info *file.Info) (Version, bool) {
+	name := info.Name()
+	replaced := info.ModTime()
+	if i := strings.Index(name, "."); i >= 0 {
+		t, err := strconv.ParseInt(name[i+1:], 10, 64)
+		if err != nil {
+			return Version{}, false
+		}
+		replaced = time.Unix(t, 0)
+		name = name[:i]
+	}
+	n, err := strconv.Atoi(name)
+	if err != nil || n <= 0 || info.IsDir() == true {
+		return Version{}, false
+	}
+
+	return Version{Number: n, Size: info.Size(), ModTime: info.ModTime(), Replaced: replaced, name: info.Name()}, true
+}
+
+// resolve maps "path;N" to the file of the version when it exists. A file
+// whose name looks like a version keeps being read as it is.
+func (r *Manager) resolve(ctx context.Context, p string) (string, bool) {
+	base, n, ok := split(p)
+	if ok == false {
+		return p, false
+	}
+	if _, err := r.ManagerV2.Stat(ctx, p); os.IsNotExist(err) == false {
+		return p, false
+	}
+	versions, err := r.Versions(ctx, base)
+	if err != nil {
+		return p, false
+	}
+	for _, v := range versions {
+		if v.Number == n {
+			return filepath.Join(r.store(base), v.name), true
+		}
+	}
+
+	return p, false
+}
+
+func (r *Manager) Stat(ctx context.Context, p string) (*file.Info, error) {
+	v, ok := r.resolve(ctx, p)
+	if ok == false {
+		return r.ManagerV2.Stat(ctx, p)
+	}
+
+	info, err := r.ManagerV2.Stat(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	attr := info.Attr()
+	attr.Name = filepath.Base(p)
+
+	return attr.Info(), nil
+}
+
+func (r *Manager) List(ctx context.Context, p string) ([]*file.Info, error) {
+	list, err := r.ManagerV2.List(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]*file.Info, 0, len(list))
+	for _, v := range list {
+		if filepath.Join(p, v.Name()) != r.Dir {
+			visible = append(visible, v)
+		}
+	}
+	return visible, nil
+}
+
+func (r *Manager) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	v, _ := r.resolve(ctx, p)
+	return r.ManagerV2.Get(ctx, v)
+}
+
+func (r *Manager) GetAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	v, _ := r.resolve(ctx, p)
+	return file.GetAt(ctx, r.ManagerV2, v, offset)
+}
+
+// Put writes the upload of an existing file to the store, and replaces the
+// file with it on Close.
+func (r *Manager) Put(ctx context.Context, p string) (io.WriteCloser, error) {
+	if r.inStore(p) == true {
+		return nil, &os.PathError{Op: "create", Path: p, Err: os.ErrPermission}
+	}
+
+	info, err := r.ManagerV2.Stat(ctx, p)
+	if err != nil || info.IsDir() == true {
+		return r.ManagerV2.Put(ctx, p)
+	}
+	dir := r.store(p)
+	if err := file.MkdirAll(ctx, r.ManagerV2, dir); err != nil {
+		return nil, err
+	}
+	upload := filepath.Join(dir, fmt.Sprintf(".upload-%d", time.Now().UnixNano()))
+	w, err := r.ManagerV2.Put(ctx, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{WriteCloser: w, manager: r, path: p, upload: upload}, nil
+}
+
+// Rename saves the file it replaces as a version of the new path.
+func (r *Manager) Rename(ctx context.Context, old string, new string) error {
+	if r.inStore(old) == true || r.inStore(new) == true {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrPermission}
+	}
+
+	saved, err := r.save(ctx, new)
+	if err != nil {
+		return err
+	}
+	if err := r.ManagerV2.Rename(ctx, old, new); err != nil {
+		r.undo(new, saved)
+		return err
+	}
+	r.prune(ctx, new)
+
+	return nil
+}
+
+// Versions returns the versions of p, latest first.
+func (r *Manager) Versions(ctx context.Context, p string) ([]Version, error) {
+	list, err := r.ManagerV2.List(ctx, r.store(p))
+	if os.IsNotExist(err) == true {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(list))
+	for _, v := range list {
+		if version, ok := parse(v); ok == true {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Number > versions[j].Number
+	})
+
+	return versions, nil
+}
+
+// save moves the file of p to a new version and returns its path, which is
+// empty when there is no file to keep.
+func (r *Manager) save(ctx context.Context, p string) (string, error) {
+	info, err := r.ManagerV2.Stat(ctx, p)
+	if os.IsNotExist(err) == true {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() == true {
+		return "", nil
+	}
+
+	versions, err := r.Versions(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	n := 1
+	if len(versions) > 0 {
+		n = versions[0].Number + 1
+	}
+
+	dir := r.store(p)
+	if err := file.MkdirAll(ctx, r.ManagerV2, dir); err != nil {
+		return "", err
+	}
+	saved := filepath.Join(dir, fmt.Sprintf("%d.%d", n, time.Now().Unix()))
+	if err := r.ManagerV2.Rename(ctx, p, saved); err != nil {
+		return "", err
+	}
+
+	return saved, nil
+}
+
+// undo runs without the context of the failed operation, which may have been
+// canceled.
+func (r *Manager) undo(p string, saved string) {
+	if len(saved) == 0 {
+		return
+	}
+	if err := r.ManagerV2.Rename(context.Background(), saved, p); err != nil {
+		log.Printf("failed to restore version: path=%v, err=%v", p, err)
+	}
+}
+
+// prune removes the versions beyond Keep and replaced before MaxAge.
+func (r *Manager) prune(ctx context.Context, p string) {
+	versions, err := r.Versions(ctx, p)
+	if err != nil {
+		log.Printf("failed to list versions: path=%v, err=%v", p, err)
+		return
+	}
+
+	for i, v := range versions {
+		if (r.Keep <= 0 || i < r.Keep) && (r.MaxAge <= 0 || time.Since(v.Replaced) < r.MaxAge) {
+			continue
+		}
+		if err := r.ManagerV2.Remove(ctx, filepath.Join(r.store(p), v.name)); err != nil {
+			log.Printf("failed to remove version: path=%v, version=%v, err=%v", p, v.Number, err)
+		}
+	}
+}
+
+type writer struct {
+	io.WriteCloser
+	manager *Manager
+	path    string
+	upload  string
+	done    bool
+}
+
+// Close saves the current file as a version right before the upload takes
+// its place, and moves it back when that fails.
+func (r *writer) Close() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	if err := r.WriteCloser.Close(); err != nil {
+		r.discard()
+		return err
+	}
+	ctx := context.Background()
+	saved, err := r.manager.save(ctx, r.path)
+	if err != nil {
+		r.discard()
+		return err
+	}
+	if err := r.manager.ManagerV2.Rename(ctx, r.upload, r.path); err != nil {
+		r.manager.undo(r.path, saved)
+		r.discard()
+		return err
+	}
+	r.manager.prune(ctx, r.path)
+
+	return nil
+}
+
+func (r *writer) Abort() error {
+	if r.done == true {
+		return nil
+	}
+	r.done = true
+
+	err := file.Abort(r.WriteCloser)
+	r.discard()
+
+	return err
+}
+
+func (r *writer) discard() {
+	err := r.manager.ManagerV2.Remove(context.Background(), r.upload)
+	if err != nil && os.IsNotExist(err) == false {
+		log.Printf("failed to remove upload: path=%v, err=%v", r.upload, err)
+	}
+}
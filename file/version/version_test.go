@@ -0,0 +1,113 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package version
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/filetest"
+	"github.com/donamKim/ftp-server-go/file/memory"
+)
+
+func TestConformance(t *testing.T) {
+	filetest.Run(t, filetest.Backend{New: func(t *testing.T) (file.ManagerV2, string) {
+		fs := memory.New()
+		fs.MkdirAll("/srv")
+		return New(fs, "/srv/.versions", 0, 0), "/srv"
+	}})
+}
+
+func TestPutKeepsFileUntilClose(t *testing.T) {
+	fs := memory.New()
+	fs.MkdirAll("/srv")
+	m := New(fs, "/srv/.versions", 0, 0)
+
+	filetest.Put(t, m, "/srv/f", "one")
+	w := filetest.Create(t, m, "/srv/f", "two")
+	if v := filetest.Read(t, m, "/srv/f", 0); v != "one" {
+		t.Fatalf("file changed before close: %q", v)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v := filetest.Read(t, m, "/srv/f", 0); v != "two" {
+		t.Fatalf("unexpected file: %q", v)
+	}
+	if v := filetest.Read(t, m, "/srv/f;1", 0); v != "one" {
+		t.Fatalf("unexpected version: %q", v)
+	}
+
+	w = filetest.Create(t, m, "/srv/f", "three")
+	if err := file.Abort(w); err != nil {
+		t.Fatal(err)
+	}
+	if v := filetest.Read(t, m, "/srv/f", 0); v != "two" {
+		t.Fatalf("aborted upload replaced the file: %q", v)
+	}
+	versions, err := m.Versions(context.Background(), "/srv/f")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("unexpected versions: %v, err=%v", versions, err)
+	}
+	list, err := fs.List(context.Background(), "/srv/.versions/srv/f")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("aborted upload left files: %v, err=%v", list, err)
+	}
+}
+
+func TestMaxAgeCountsFromReplacement(t *testing.T) {
+	fs := memory.New()
+	fs.MkdirAll("/srv")
+	m := New(fs, "/srv/.versions", 0, time.Hour)
+
+	filetest.Put(t, m, "/srv/f", "old")
+	if err := fs.Chtimes(context.Background(), "/srv/f", time.Now().Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	filetest.Put(t, m, "/srv/f", "new")
+	if v := filetest.Read(t, m, "/srv/f;1", 0); v != "old" {
+		t.Fatalf("version of an old file was pruned: %q", v)
+	}
+}
+
+func TestFileNamedLikeVersion(t *testing.T) {
+	fs := memory.New()
+	fs.MkdirAll("/srv")
+	m := New(fs, "/srv/.versions", 0, 0)
+
+	for _, v := range []string{"one", "two", "three"} {
+		filetest.Put(t, m, "/srv/f", v)
+	}
+	filetest.Put(t, m, "/srv/f;1", "file")
+
+	if v := filetest.Read(t, m, "/srv/f;1", 0); v != "file" {
+		t.Fatalf("unexpected file: %q", v)
+	}
+	info, err := m.Stat(context.Background(), "/srv/f;1")
+	if err != nil || info.Size() != 4 {
+		t.Fatalf("unexpected info: %v, err=%v", info, err)
+	}
+	if v := filetest.Read(t, m, "/srv/f;2", 0); v != "two" {
+		t.Fatalf("unexpected version: %q", v)
+	}
+}
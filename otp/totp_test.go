@@ -0,0 +1,90 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package otp
+
+import (
+	"testing"
+	"time"
+)
+
+// secret is the SHA-1 key of RFC 6238, "12345678901234567890".
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerate(t *testing.T) {
+	// The 8 digit codes of RFC 6238 Appendix B, truncated to Digits.
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range tests {
+		code, err := Generate(secret, Counter(time.Unix(v.time, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := v.code[len(v.code)-Digits:]; code != want {
+			t.Errorf("unexpected code: time=%v, code=%v, want=%v", v.time, code, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	for i := int64(-2); i <= 2; i++ {
+		code, err := Generate(secret, Counter(now)+i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter, ok := Validate(secret, code, now)
+		if want := i >= -Skew && i <= Skew; ok != want {
+			t.Errorf("unexpected result: periods=%v, ok=%v", i, ok)
+		}
+		if ok == true && counter != Counter(now)+i {
+			t.Errorf("unexpected counter: periods=%v, counter=%v", i, counter)
+		}
+	}
+
+	if _, ok := Validate(secret, "05047", now); ok == true {
+		t.Error("short code was accepted")
+	}
+	if _, ok := Validate("not base32!", "050471", now); ok == true {
+		t.Error("code of an invalid secret was accepted")
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	for _, v := range []string{secret, "gezd gnbv gy3t qojq", secret + "===="} {
+		if err := CheckSecret(v); err != nil {
+			t.Errorf("valid secret refused: secret=%q, err=%v", v, err)
+		}
+	}
+	for _, v := range []string{"", "GEZDGNB1", "not base32!"} {
+		if err := CheckSecret(v); err == nil {
+			t.Errorf("invalid secret accepted: secret=%q", v)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Access decides which remote addresses are permitted. A deny rule always
+// wins; when the allow list is empty every address that is not denied is
+// permitted.
+type Access struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+func NewAccess(allow []string, deny []string) (*Access, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	v := new(Access)
+	var err error
+	if v.Allow, err = ParseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if v.Deny, err = ParseNetworks(deny); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// ParseNetworks parses CIDR notations. A bare IPv4 or IPv6 address is
+// treated as a single host network.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if strings.Contains(v, "/") == false {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %v", v)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				networks = append(networks, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func (r *Access) Permit(ip net.IP) bool {
+	if r == nil {
+		return true
+	}
+	if containsIP(r.Deny, ip) == true {
+		return false
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+
+	return containsIP(r.Allow, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, v := range networks {
+		if v.Contains(ip) == true {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file/memory"
+)
+
+func TestAccessPermit(t *testing.T) {
+	tests := []struct {
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{nil, nil, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.1"}, "192.0.2.2", true},
+		{nil, []string{"192.0.2.0/24"}, "192.0.2.9", false},
+		{nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{[]string{"192.0.2.1"}, []string{"0.0.0.0/0"}, "192.0.2.1", false},
+		{[]string{"10.0.0.0/8"}, nil, "::ffff:10.1.2.3", true},
+		{[]string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{[]string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{[]string{"2001:db8::/32"}, []string{"2001:db8::1"}, "2001:db8::1", false},
+		{[]string{" 2001:db8::2 "}, nil, "2001:db8::2", true},
+		{[]string{"2001:db8::/32"}, nil, "192.0.2.1", false},
+		{[]string{"192.0.2.0/24"}, nil, "2001:db8::1", false},
+	}
+	for _, v := range tests {
+		access, err := NewAccess(v.allow, v.deny)
+		if err != nil {
+			t.Fatalf("allow=%v, deny=%v: %v", v.allow, v.deny, err)
+		}
+		if got := access.Permit(net.ParseIP(v.ip)); got != v.want {
+			t.Errorf("allow=%v, deny=%v, ip=%v: got %v, want %v", v.allow, v.deny, v.ip, got, v.want)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	list, err := ParseNetworks([]string{"192.0.2.1", "2001:db8::1", "192.0.2.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.1/32", "2001:db8::1/128", "192.0.2.0/24", "2001:db8::/32"}
+	for i, v := range list {
+		if v.String() != want[i] {
+			t.Errorf("unexpected network: %v, want %v", v, want[i])
+		}
+	}
+
+	for _, v := range []string{"", "example.com", "192.0.2.256", "192.0.2.0/33", "2001:db8::/129", "192.0.2.0/"} {
+		if _, err := ParseNetworks([]string{v}); err == nil {
+			t.Errorf("invalid network accepted: %q", v)
+		}
+	}
+}
+
+func TestAccessReload(t *testing.T) {
+	deny, err := NewAccess(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow, err := NewAccess([]string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	svr := &Server{Users: []User{{Name: "user", Password: "pass"}}, Manager: memory.New()}
+	c := &conn{ctx: context.Background(), server: svr, remoteAddr: &net.TCPAddr{IP: ip}}
+
+	if svr.permit(ip) == false || c.login(svr.lookupUser("user")) == false {
+		t.Fatal("refused without rules")
+	}
+
+	svr.Reload([]User{{Name: "user", Password: "pass", Access: deny}}, deny, nil, nil)
+	if svr.permit(ip) == true {
+		t.Fatal("permitted a denied connection after reload")
+	}
+	if c.login(svr.lookupUser("user")) == true {
+		t.Fatal("permitted a denied login after reload")
+	}
+
+	svr.Reload([]User{{Name: "user", Password: "pass", Access: allow}}, allow, nil, nil)
+	if svr.permit(ip) == false || c.login(svr.lookupUser("user")) == false {
+		t.Fatal("refused an allowed address after reload")
+	}
+	if svr.permit(net.ParseIP("198.51.100.1")) == true {
+		t.Fatal("permitted an address outside the allow list")
+	}
+}
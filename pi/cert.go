@@ -0,0 +1,89 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+)
+
+// matchCertificate reports whether the client certificate satisfies one of
+// the rules. A rule is "cn:<common name>", "san:<subject alternative name>"
+// or "sha256:<fingerprint>", where the fingerprint may contain colons.
+func matchCertificate(cert *x509.Certificate, rules []string) bool {
+	if cert == nil {
+		return false
+	}
+
+	for _, v := range rules {
+		s := strings.SplitN(v, ":", 2)
+		if len(s) != 2 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(s[0])) {
+		case "cn":
+			if cert.Subject.CommonName == s[1] {
+				return true
+			}
+		case "san":
+			for _, name := range subjectAltNames(cert) {
+				if name == s[1] {
+					return true
+				}
+			}
+		case "sha256":
+			sum := sha256.Sum256(cert.Raw)
+			if hex.EncodeToString(sum[:]) == strings.ToLower(strings.Replace(s[1], ":", "", -1)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func subjectAltNames(cert *x509.Certificate) []string {
+	names := make([]string, 0)
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, v := range cert.IPAddresses {
+		names = append(names, v.String())
+	}
+	for _, v := range cert.URIs {
+		names = append(names, v.String())
+	}
+
+	return names
+}
+
+func (r *conn) peerCertificate() *x509.Certificate {
+	if r.tlsConn == nil {
+		return nil
+	}
+	state := r.tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return state.PeerCertificates[0]
+}
@@ -0,0 +1,157 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/donamKim/ftp-server-go/file/memory"
+)
+
+func TestMatchCertificate(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/alice")
+	cert := &x509.Certificate{
+		Raw:            []byte("certificate"),
+		Subject:        pkix.Name{CommonName: "alice"},
+		DNSNames:       []string{"alice.example.com"},
+		EmailAddresses: []string{"alice@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("192.0.2.1")},
+		URIs:           []*url.URL{uri},
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := fmt.Sprintf("%x", sum)
+	colons := strings.ToUpper(fmt.Sprintf("% x", sum))
+
+	tests := []struct {
+		rules []string
+		want  bool
+	}{
+		{[]string{"cn:alice"}, true},
+		{[]string{"CN:alice"}, true},
+		{[]string{"cn:Alice"}, false},
+		{[]string{"cn:bob", "cn:alice"}, true},
+		{[]string{"san:alice.example.com"}, true},
+		{[]string{"san:alice@example.com"}, true},
+		{[]string{"san:192.0.2.1"}, true},
+		{[]string{"san:spiffe://example.com/alice"}, true},
+		{[]string{"san:alice"}, false},
+		{[]string{"sha256:" + fingerprint}, true},
+		{[]string{"sha256:" + strings.Replace(colons, " ", ":", -1)}, true},
+		{[]string{"sha256:" + fingerprint[1:]}, false},
+		{[]string{"alice"}, false},
+		{[]string{"dn:alice"}, false},
+		{nil, false},
+	}
+	for _, v := range tests {
+		if got := matchCertificate(cert, v.rules); got != v.want {
+			t.Errorf("rules=%v: got %v, want %v", v.rules, got, v.want)
+		}
+	}
+	if matchCertificate(nil, []string{"cn:alice"}) == true {
+		t.Error("missing certificate matched")
+	}
+}
+
+func TestCertificateLogin(t *testing.T) {
+	config, ca := newTLSConfig(t)
+	alice := newClientCertificate(t, ca, "alice")
+	bob := newClientCertificate(t, ca, "bob")
+	mallory := newClientCertificate(t, ca, "mallory")
+	sum := sha256.Sum256(bob.x509.Raw)
+
+	addr := startServer(t, &Server{
+		Users: []User{
+			{Name: "alice", Password: "alice", Certificates: []string{"cn:alice"}},
+			{Name: "bob", Password: "bob", Certificates: []string{fmt.Sprintf("sha256:%x", sum)}, RequireCertificate: true},
+		},
+		Manager:   memory.New(),
+		Root:      "/",
+		TLSConfig: config,
+	})
+
+	t.Run("certificate only", func(t *testing.T) {
+		c := dial(t, addr)
+		c.secure(&alice.tls)
+		c.expect(replyLoggedInSecure, "USER alice")
+		c.expect(replyFileActionOkay, "CWD /")
+	})
+	t.Run("certificate and password", func(t *testing.T) {
+		c := dial(t, addr)
+		c.secure(&bob.tls)
+		c.expect(replyUserNameOkay, "USER bob")
+		c.expect(replyNotLoggedIn, "PASS wrong")
+		c.expect(replyUserNameOkay, "USER bob")
+		c.expect(replyLoggedIn, "PASS bob")
+	})
+	t.Run("required certificate missing", func(t *testing.T) {
+		c := dial(t, addr)
+		c.secure(nil)
+		c.expect(replyUserNameOkay, "USER bob")
+		c.expect(replyNotLoggedIn, "PASS bob")
+
+		c = dial(t, addr)
+		c.expect(replyUserNameOkay, "USER bob")
+		c.expect(replyNotLoggedIn, "PASS bob")
+	})
+	t.Run("certificate of another user", func(t *testing.T) {
+		c := dial(t, addr)
+		c.secure(&alice.tls)
+		c.expect(replyUserNameOkay, "USER bob")
+		c.expect(replyNotLoggedIn, "PASS bob")
+	})
+	t.Run("certificate matching no user", func(t *testing.T) {
+		c := dial(t, addr)
+		c.secure(&mallory.tls)
+		c.expect(replyUserNameOkay, "USER alice")
+		c.expect(replyNotLoggedIn, "CWD /")
+		c.expect(replyLoggedIn, "PASS alice")
+
+		c = dial(t, addr)
+		c.secure(&mallory.tls)
+		c.expect(replyUserNameOkay, "USER mallory")
+		c.expect(replyNotLoggedIn, "PASS mallory")
+	})
+}
+
+func TestCertificateLoginPolicy(t *testing.T) {
+	config, ca := newTLSConfig(t)
+	alice := newClientCertificate(t, ca, "alice")
+	addr := startServer(t, &Server{
+		Users:     []User{{Name: "alice", Password: "alice", Certificates: []string{"cn:alice"}}},
+		Manager:   memory.New(),
+		Root:      "/",
+		TLSConfig: config,
+		TLSPolicy: &TLSPolicy{RequireLogin: true},
+	})
+
+	c := dial(t, addr)
+	c.expect(replyDeniedPolicy, "USER alice")
+	c.expect(replyNotLoggedIn, "PASS alice")
+	c.secure(&alice.tls)
+	c.expect(replyLoggedInSecure, "USER alice")
+}
@@ -42,8 +42,11 @@ func newCMD(s string) *cmd {
 
 var commands = map[string]task{
 	"AUTH": new(taskAUTH),
+	"PBSZ": new(taskPBSZ),
+	"PROT": new(taskPROT),
 	"USER": new(taskUSER),
 	"PASS": new(taskPASS),
+	"ACCT": new(taskACCT),
 	"FEAT": new(taskFEAT),
 	"PWD":  new(taskPWD),
 	"TYPE": new(taskTYPE),
@@ -55,9 +58,22 @@ var commands = map[string]task{
 	"CWD":  new(taskCWD),
 	"RETR": new(taskRETR),
 	"STOR": new(taskSTOR),
+	"APPE": new(taskAPPE),
+	"REST": new(taskREST),
+	"MKD":  new(taskMKD),
 	"DELE": new(taskDELE),
 	"RMD":  new(taskRMD),
 	"RNFR": new(taskRNFR),
 	"RNTO": new(taskRNTO),
 	"SIZE": new(taskSIZE),
+	"STAT": new(taskSTAT),
+	"SITE": new(taskSITE),
+	"OPTS": new(taskOPTS),
+	"HASH": new(taskHASH),
+	"RANG": new(taskRANG),
+
+	"XCRC":    &taskXHASH{algorithm: "CRC32"},
+	"XMD5":    &taskXHASH{algorithm: "MD5"},
+	"XSHA1":   &taskXHASH{algorithm: "SHA-1"},
+	"XSHA256": &taskXHASH{algorithm: "SHA-256"},
 }
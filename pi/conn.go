@@ -22,64 +22,276 @@ package pi
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/donamKim/ftp-server-go/dtp"
 	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/quota"
+	"github.com/donamKim/ftp-server-go/file/trash"
+	"github.com/donamKim/ftp-server-go/file/version"
+)
+
+const (
+	trashDir    = ".trash"
+	versionsDir = ".versions"
+
+	// commandQueue is how many commands are read ahead of the one executed.
+	commandQueue = 16
 )
 
 type conn struct {
 	socket      *dtp.Socket
+	netConn     net.Conn
+	tlsConfig   *tls.Config
+	tlsConn     *tls.Conn
 	reader      *bufio.Reader
 	writer      *bufio.Writer
-	manager     file.Manager
+	ctx         context.Context
+	cancel      context.CancelFunc
+	base        file.ManagerV2
+	manager     file.ManagerV2
+	closer      io.Closer
+	quotas      []*quota.Tree
+	trash       *trash.Manager
+	versions    *version.Manager
 	addr        *net.TCPAddr
-	user        User
+	remoteAddr  *net.TCPAddr
+	server      *Server
+	account     *User
+	pending     *User
 	requester   string
 	directory   string
 	passivePort []int
 	loggedIn    bool
+	certified   bool
+	prot        string
 	rnfr        string
+	cpfr        string
+	umask       os.FileMode
+	umaskSet    bool
+	hash        string
+	rang        *byteRange
+	rest        int64
+	typeCode    string
+	sent        int64
+	received    int64
+	last        int64
+
+	writeMutex    sync.Mutex
+	transferMutex sync.Mutex
+	transfer      *transfer
+}
+
+// transfer is the data transfer in progress, which is reported by a STAT
+// read while the command is executed. The size is -1 when it is unknown.
+type transfer struct {
+	name  string
+	size  int64
+	bytes int64
+}
+
+func (r *transfer) Write(p []byte) (int, error) {
+	atomic.AddInt64(&r.bytes, int64(len(p)))
+	return len(p), nil
+}
+
+func (r *transfer) progress() string {
+	bytes := atomic.LoadInt64(&r.bytes)
+	if r.size < 0 {
+		return fmt.Sprintf("Transfer in progress: %v, %v bytes.", r.name, bytes)
+	}
+	return fmt.Sprintf("Transfer in progress: %v, %v of %v bytes.", r.name, bytes, r.size)
 }
 
 func (r *conn) serve() {
+	defer r.close()
+
 	r.write(&reply{code: replyHello, message: "Service ready for new user."})
 
+	cmds := make(chan *cmd, commandQueue)
+	resume := make(chan struct{})
+	go r.readCommands(cmds, resume)
+
+	for cmd := range cmds {
+		r.dispatch(cmd)
+		if cmd.fn == "AUTH" {
+			resume <- struct{}{}
+		}
+	}
+}
+
+// readCommands reads the control connection while the commands are executed,
+// and cancels the session as soon as the client is gone, so a transfer in
+// progress is not left running. A STAT during a transfer is answered here
+// with its progress. It waits for AUTH to be executed, which replaces the
+// reader of the connection.
+func (r *conn) readCommands(cmds chan<- *cmd, resume <-chan struct{}) {
+	defer close(cmds)
+	defer r.cancel()
+
 	for {
 		cmd, err := r.read()
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("reader error: %v", err)
 			}
-			break
+			return
+		}
+		if cmd.fn == "STAT" && len(cmd.param) == 0 {
+			if t := r.currentTransfer(); t != nil {
+				r.write(&reply{code: replySystemStatus, message: t.progress()})
+				continue
+			}
+		}
+		cmds <- cmd
+		if cmd.fn == "AUTH" {
+			<-resume
+		}
+	}
+}
+
+func (r *conn) dispatch(cmd *cmd) {
+	task := commands[cmd.fn]
+	if task == nil {
+		log.Printf("not found command: %v", cmd.fn)
+		r.write(&reply{code: replyNotFoundCommand, message: "This command is not found."})
+	} else if task.supported() == false {
+		log.Printf("not supported command: %v", cmd.fn)
+		r.write(&reply{code: replyNotSupportedParameter, message: "This command is not supported."})
+	} else if task.requirePermission() == true && r.loggedIn == false {
+		log.Printf("not permission to command: %v", cmd.fn)
+		r.write(&reply{code: replyNotLoggedIn, message: "Not permission to this command."})
+	} else if err := task.parse(cmd.param); err != nil {
+		log.Printf("invalid parameter: fn=%v, err=%v", cmd.fn, err)
+		r.write(&reply{code: replyInvalidParameter, message: fmt.Sprintf("Invalid parameter: %v", err)})
+	} else {
+		log.Printf("execute command: %v", cmd.fn)
+		task.execute(r)
+	}
+}
+
+func (r *conn) close() {
+	r.cancel()
+	if r.socket != nil {
+		r.socket.Close()
+		r.socket = nil
+	}
+	if r.closer != nil {
+		if err := r.closer.Close(); err != nil {
+			log.Printf("failed to close file manager: %v", err)
+		}
+	}
+	if err := r.netConn.Close(); err != nil {
+		log.Printf("failed to close connection: %v", err)
+	}
+}
+
+func (r *conn) login(user *User) bool {
+	if user.Access.Permit(r.remoteAddr.IP) == false {
+		log.Printf("denied login: user=%v, addr=%v", user.Name, r.remoteAddr)
+		return false
+	}
+	manager, err := r.server.newManager(user)
+	if err != nil {
+		log.Printf("failed to create file manager: user=%v, err=%v", user.Name, err)
+		return false
+	}
+	// The default manager is shared by the sessions and never closed.
+	var closer io.Closer
+	if manager == nil {
+		manager = r.server.defaultManager()
+	} else {
+		closer, _ = manager.(io.Closer)
+	}
+	directory := r.server.Root
+	if len(user.Root) > 0 {
+		directory = user.Root
+	}
+
+	// The trash wraps the quota, so moving files to the trash keeps them
+	// charged until they are purged. The versions are below the trash, which
+	// would keep the pruned versions otherwise.
+	wrapped := manager
+	quotas := r.server.quotas(user)
+	if len(quotas) > 0 {
+		wrapped = quota.New(wrapped, quotas...)
+	}
+	var versions *version.Manager
+	if user.Versions > 0 || user.VersionsMaxAge > 0 {
+		versions = version.New(wrapped, filepath.Join(directory, versionsDir), user.Versions, user.VersionsMaxAge)
+		wrapped = versions
+	}
+	var bin *trash.Manager
+	if user.Trash == true {
+		if bin, err = trash.New(wrapped, filepath.Join(directory, trashDir), user.TrashRetention); err != nil {
+			log.Printf("failed to create trash: user=%v, err=%v", user.Name, err)
+			if closer != nil {
+				closer.Close()
+			}
+			return false
 		}
+		bin.Schedule = &r.server.trashes
+		bin.PurgeExpired(r.ctx)
+		wrapped = bin
+	}
 
-		task := commands[cmd.fn]
-		if task == nil {
-			log.Printf("not found command: %v", cmd.fn)
-			r.write(&reply{code: replyNotFoundCommand, message: "This command is not found."})
-		} else if task.supported() == false {
-			log.Printf("not supported command: %v", cmd.fn)
-			r.write(&reply{code: replyNotSupportedParameter, message: "This command is not supported."})
-		} else if task.requirePermission() == true && r.loggedIn == false {
-			log.Printf("not permission to command: %v", cmd.fn)
-			r.write(&reply{code: replyNotLoggedIn, message: "Not permission to this command."})
-		} else if err := task.parse(cmd.param); err != nil {
-			log.Printf("invalid parameter: fn=%v, err=%v", cmd.fn, err)
-			r.write(&reply{code: replyInvalidParameter, message: fmt.Sprintf("Invalid parameter: %v", err)})
-		} else {
-			log.Printf("execute command: %v", cmd.fn)
-			task.execute(r)
+	// Nothing of a previous login on the connection is kept, like the
+	// privsep helper running as the previous user.
+	if r.closer != nil {
+		if err := r.closer.Close(); err != nil {
+			log.Printf("failed to close file manager: %v", err)
 		}
 	}
+	r.closer = closer
+	r.base = manager
+	r.manager = wrapped
+	r.directory = directory
+	r.quotas = quotas
+	r.versions = versions
+	r.trash = bin
+
+	r.account = user
+	r.loggedIn = true
+	return true
+}
+
+// secure upgrades the control connection to TLS after a successful AUTH.
+func (r *conn) secure() error {
+	conn := tls.Server(r.netConn, r.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	r.tlsConn = conn
+	r.reader = bufio.NewReader(conn)
+	r.writer = bufio.NewWriter(conn)
+	return nil
+}
+
+func (r *conn) secureSocket() error {
+	if r.prot != "P" {
+		return nil
+	}
+
+	return r.socket.Secure(r.tlsConfig)
 }
 
 func (r *conn) write(reply *reply) {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+
 	if _, err := r.writer.WriteString(reply.make()); err != nil {
 		log.Printf("failed to write relpy: code=%v, message=%v, err=%v", reply.code, reply.message, err)
 	} else {
@@ -90,6 +302,72 @@ func (r *conn) write(reply *reply) {
 	}
 }
 
+// writeFileError replies to a failed file action, telling an exceeded quota
+// apart from the other failures.
+func (r *conn) writeFileError(err error) {
+	if err == quota.ErrExceeded {
+		r.write(&reply{code: replyExceededStorage, message: "Exceeded storage allocation."})
+		return
+	}
+	r.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+}
+
+// status describes the session for a STAT between the transfers, with the
+// size of the last one.
+func (r *conn) status() string {
+	var buf bytes.Buffer
+	buf.WriteString("FTP server status:\n")
+	fmt.Fprintf(&buf, " Connected from %v\n", r.remoteAddr)
+	if r.loggedIn == true {
+		fmt.Fprintf(&buf, " Logged in as %v\n", r.account.Name)
+	} else {
+		buf.WriteString(" Not logged in\n")
+	}
+	typeName := "ASCII"
+	if r.typeCode == "I" {
+		typeName = "Image"
+	}
+	fmt.Fprintf(&buf, " TYPE: %v, STRUcture: File, MODE: Stream\n", typeName)
+	if r.tlsConn != nil {
+		prot := "Clear"
+		if r.prot == "P" {
+			prot = "Private"
+		}
+		fmt.Fprintf(&buf, " Control connection secured, data protection: %v\n", prot)
+	}
+	if r.socket != nil {
+		fmt.Fprintf(&buf, " Data connection ready on port %v\n", r.socket.Port)
+	} else {
+		buf.WriteString(" No data connection\n")
+	}
+	buf.WriteString(" No data transfer in progress\n")
+	fmt.Fprintf(&buf, " Bytes sent: %v, received: %v, last transfer: %v\n", r.sent, r.received, r.last)
+
+	return buf.String()
+}
+
+// creating tells whether a write to the path creates the file, which is
+// asked only when SITE UMASK has to be applied.
+func (r *conn) creating(path string) bool {
+	if r.umaskSet == false {
+		return false
+	}
+	_, err := r.manager.Stat(r.ctx, path)
+	return os.IsNotExist(err)
+}
+
+// applyUmask sets the mode of a file created after SITE UMASK, which leaves
+// the mode to the storage otherwise.
+func (r *conn) applyUmask(path string, mode os.FileMode) {
+	if r.umaskSet == false {
+		return
+	}
+	err := file.Chmod(r.ctx, r.manager, path, mode&^r.umask)
+	if err != nil && err != file.ErrNotSupported {
+		log.Printf("failed to apply umask: path=%v, err=%v", path, err)
+	}
+}
+
 func (r *conn) read() (*cmd, error) {
 	cmd, err := r.reader.ReadString('\n')
 	if err != nil {
@@ -99,18 +377,110 @@ func (r *conn) read() (*cmd, error) {
 	return newCMD(cmd), nil
 }
 
-func (r *conn) writeSocket(f io.Reader) {
+// sourceError is a failure to read what writeSocket sends, rather than to
+// write the data connection.
+type sourceError struct {
+	error
+}
+
+type sourceReader struct {
+	io.Reader
+}
+
+func (r sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = sourceError{err}
+	}
+	return n, err
+}
+
+func (r *conn) writeSocket(f io.Reader, t *transfer) error {
 	if r.socket == nil {
-		return
+		return errors.New("no data connection")
 	}
 
-	if _, err := io.Copy(r.socket, f); err != nil {
+	r.last = 0
+	err := r.secureSocket()
+	if err == nil {
+		r.beginTransfer(t)
+		var n int64
+		n, err = io.Copy(io.MultiWriter(r.socket, t), sourceReader{f})
+		r.endTransfer()
+		r.sent += n
+		r.last = n
+	}
+	if err != nil {
 		log.Printf("failed to write socket: %v", err)
 	}
-	if err := r.socket.Close(); err != nil {
-		log.Printf("failed to close socket: %v", err)
+	if errClose := r.socket.Close(); errClose != nil {
+		log.Printf("failed to close socket: %v", errClose)
+	}
+	r.socket = nil
+
+	return err
+}
+
+func (r *conn) beginTransfer(t *transfer) {
+	r.transferMutex.Lock()
+	defer r.transferMutex.Unlock()
+	r.transfer = t
+}
+
+func (r *conn) endTransfer() {
+	r.transferMutex.Lock()
+	defer r.transferMutex.Unlock()
+	r.transfer = nil
+}
+
+func (r *conn) currentTransfer() *transfer {
+	r.transferMutex.Lock()
+	defer r.transferMutex.Unlock()
+	return r.transfer
+}
+
+// writeTransferError replies to a failed download, which is 451 when the
+// data could not be read, and 426 when the data connection failed.
+func (r *conn) writeTransferError(err error) {
+	if v, ok := err.(sourceError); ok == true {
+		r.write(&reply{code: replyAbortedLocal, message: fmt.Sprintf("Requested action aborted: %v", v.error)})
+		return
+	}
+	r.write(&reply{code: replyAbortedTransfer, message: fmt.Sprintf("Connection closed; transfer aborted: %v", err)})
+}
+
+// readSocket copies the data connection into the writer. The upload is
+// committed by closing the writer only when the copy succeeded, and aborted
+// otherwise.
+func (r *conn) readSocket(w io.WriteCloser, t *transfer) error {
+	if r.socket == nil {
+		file.Abort(w)
+		return errors.New("no data connection")
+	}
+
+	r.last = 0
+	err := r.secureSocket()
+	if err == nil {
+		r.beginTransfer(t)
+		var n int64
+		n, err = io.Copy(io.MultiWriter(w, t), r.socket)
+		r.endTransfer()
+		r.received += n
+		r.last = n
+	}
+	if err != nil {
+		if errAbort := file.Abort(w); errAbort != nil {
+			log.Printf("failed to abort upload: %v", errAbort)
+		}
+	} else {
+		err = w.Close()
+	}
+	if errClose := r.socket.Close(); errClose != nil {
+		log.Printf("failed to close socket: %v", errClose)
 	}
 	r.socket = nil
+
+	return err
 }
 
 func (r *conn) buildPath(path string) string {
@@ -0,0 +1,221 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a port of the loopback which is not in use.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startServer serves on free ports until the test ends, and returns the
+// address of the control connection.
+func startServer(t *testing.T, svr *Server) string {
+	svr.PIPort = freePort(t)
+	svr.PassivePort = []int{freePort(t)}
+	l, err := svr.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go svr.Serve(l)
+
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(svr.PIPort))
+}
+
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &client{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.expect(replyHello, "")
+	return c
+}
+
+// reply reads a reply, skipping the lines of a multiline one.
+func (r *client) reply() (replyCode, string) {
+	r.t.Helper()
+	r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		r.t.Fatalf("failed to read reply: %v", err)
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		r.t.Fatalf("invalid reply: %q", line)
+	}
+	for line[3] == '-' && strings.HasPrefix(line, fmt.Sprintf("%d ", code)) == false {
+		if line, err = r.reader.ReadString('\n'); err != nil {
+			r.t.Fatalf("failed to read reply: %v", err)
+		}
+	}
+
+	return replyCode(code), strings.TrimSpace(line[4:])
+}
+
+// expect sends the command unless it is empty, and fails the test unless the
+// reply has the code.
+func (r *client) expect(code replyCode, command string) string {
+	r.t.Helper()
+	if len(command) > 0 {
+		fmt.Fprintf(r.conn, "%s\r\n", command)
+	}
+	got, message := r.reply()
+	if got != code {
+		r.t.Fatalf("unexpected reply: command=%q, code=%v, message=%q, want %v", command, got, message, code)
+	}
+
+	return message
+}
+
+// secure runs AUTH TLS with the client certificate, which may be nil.
+func (r *client) secure(cert *tls.Certificate) {
+	r.t.Helper()
+	r.expect(replyAuthOkay, "AUTH TLS")
+
+	conn := tls.Client(r.conn, r.tlsConfig(cert))
+	if err := conn.Handshake(); err != nil {
+		r.t.Fatalf("failed to handshake TLS: %v", err)
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+}
+
+func (r *client) tlsConfig(cert *tls.Certificate) *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config
+}
+
+// passive opens the data connection of EPSV.
+func (r *client) passive() net.Conn {
+	r.t.Helper()
+	message := r.expect(replyEPSVOkay, "EPSV")
+	port, err := strconv.Atoi(strings.Trim(message[strings.Index(message, "("):], "(|)"))
+	if err != nil {
+		r.t.Fatalf("invalid EPSV reply: %q", message)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+type certificate struct {
+	tls  tls.Certificate
+	x509 *x509.Certificate
+}
+
+// newCertificate creates a certificate signed by the parent, or self-signed
+// when the parent is nil.
+func newCertificate(t *testing.T, template *x509.Certificate, parent *certificate) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.x509, parent.tls.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &certificate{tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, x509: cert}
+}
+
+// newTLSConfig returns the server config verifying the client certificates
+// issued by the returned CA.
+func newTLSConfig(t *testing.T) (*tls.Config, *certificate) {
+	ca := newCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.x509)
+	return &tls.Config{
+		Certificates: []tls.Certificate{server.tls},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}, ca
+}
+
+func newClientCertificate(t *testing.T, ca *certificate, name string) *certificate {
+	return newCertificate(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: name},
+		DNSNames:       []string{name + ".example.com"},
+		EmailAddresses: []string{name + "@example.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
@@ -0,0 +1,353 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+const defaultHash = "SHA-256"
+
+// hashAlgorithms are listed by FEAT in this order.
+var hashAlgorithms = []string{"SHA-1", "SHA-256", "SHA-512", "MD5", "CRC32"}
+
+func newHash(name string) hash.Hash {
+	switch name {
+	case "SHA-1":
+		return sha1.New()
+	case "SHA-256":
+		return sha256.New()
+	case "SHA-512":
+		return sha512.New()
+	case "MD5":
+		return md5.New()
+	case "CRC32":
+		return crc32.NewIEEE()
+	}
+	return nil
+}
+
+// byteRange is set by RANG for the next HASH or RETR, with an inclusive end.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// hashFile streams the file through the algorithm, from the start of the
+// range up to its end or the end of the file. It returns the range hashed.
+func hashFile(conn *conn, path string, algorithm string, rang *byteRange) ([]byte, *byteRange, error) {
+	info, err := conn.manager.Stat(conn.ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() == true {
+		return nil, nil, &os.PathError{Op: "hash", Path: path, Err: syscall.EISDIR}
+	}
+
+	whole := rang == nil || (rang.start == 0 && rang.end >= info.Size()-1)
+	if whole == true && conn.server.Checksums != nil {
+		if v, ok := conn.server.Checksums.Lookup(conn.account.Storage, path, info, algorithm); ok == true {
+			if sum, err := hex.DecodeString(v); err == nil {
+				return sum, &byteRange{start: 0, end: lastByte(info.Size())}, nil
+			}
+		}
+	}
+
+	hashed := &byteRange{start: 0, end: info.Size() - 1}
+	if rang != nil {
+		hashed.start = rang.start
+		if rang.end < hashed.end {
+			hashed.end = rang.end
+		}
+	}
+	if hashed.start > 0 && hashed.start >= info.Size() {
+		return nil, nil, &os.PathError{Op: "hash", Path: path, Err: syscall.EINVAL}
+	}
+
+	reader, err := file.GetAt(conn.ctx, conn.manager, path, hashed.start)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	h := newHash(algorithm)
+	if _, err := io.Copy(h, io.LimitReader(reader, hashed.end-hashed.start+1)); err != nil {
+		return nil, nil, err
+	}
+	hashed.end = lastByte(hashed.end + 1)
+
+	sum := h.Sum(nil)
+	if whole == true {
+		conn.storeChecksums(path, info, map[string]string{algorithm: hex.EncodeToString(sum)})
+	}
+
+	return sum, hashed, nil
+}
+
+// lastByte is the end of a range of the size, which is 0 for an empty file.
+func lastByte(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	return size - 1
+}
+
+func (r *conn) storeChecksums(path string, info *file.Info, sums map[string]string) {
+	if r.server.Checksums == nil {
+		return
+	}
+	if err := r.server.Checksums.Store(r.account.Storage, path, info, sums); err != nil {
+		log.Printf("failed to store checksums: path=%v, err=%v", path, err)
+	}
+}
+
+// invalidateChecksums is called for the changes of a file which may keep its
+// size and its modification time.
+func (r *conn) invalidateChecksums(paths ...string) {
+	if r.server.Checksums == nil {
+		return
+	}
+	for _, v := range paths {
+		r.server.Checksums.Invalidate(r.account.Storage, v)
+	}
+}
+
+// invalidateChecksumDir is called for a directory removed or renamed, whose
+// files keep their size and their modification time below another path.
+func (r *conn) invalidateChecksumDir(path string) {
+	if r.server.Checksums == nil {
+		return
+	}
+	r.server.Checksums.InvalidateDir(r.account.Storage, path)
+}
+
+// hashWriter computes every algorithm of HASH while an upload passes
+// through it.
+type hashWriter struct {
+	io.WriteCloser
+	hashes map[string]hash.Hash
+}
+
+func newHashWriter(w io.WriteCloser) *hashWriter {
+	hashes := make(map[string]hash.Hash, len(hashAlgorithms))
+	for _, v := range hashAlgorithms {
+		hashes[v] = newHash(v)
+	}
+
+	return &hashWriter{WriteCloser: w, hashes: hashes}
+}
+
+func (r *hashWriter) Write(p []byte) (int, error) {
+	n, err := r.WriteCloser.Write(p)
+	for _, v := range r.hashes {
+		v.Write(p[:n])
+	}
+
+	return n, err
+}
+
+func (r *hashWriter) Abort() error {
+	return file.Abort(r.WriteCloser)
+}
+
+func (r *hashWriter) sums() map[string]string {
+	sums := make(map[string]string, len(r.hashes))
+	for k, v := range r.hashes {
+		sums[k] = hex.EncodeToString(v.Sum(nil))
+	}
+
+	return sums
+}
+
+type taskHASH struct {
+	path string
+}
+
+func (r *taskHASH) supported() bool {
+	return true
+}
+
+func (r *taskHASH) requirePermission() bool {
+	return true
+}
+
+func (r *taskHASH) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.path = param
+	return nil
+}
+
+func (r *taskHASH) execute(conn *conn) {
+	rang := conn.rang
+	conn.rang = nil
+
+	sum, hashed, err := hashFile(conn, conn.buildPath(r.path), conn.hash, rang)
+	if err != nil {
+		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+		return
+	}
+	conn.write(&reply{code: replyFileStatus, message: fmt.Sprintf("%v %v-%v %v %v", conn.hash, hashed.start, hashed.end, hex.EncodeToString(sum), r.path)})
+}
+
+type taskOPTS struct {
+	option string
+	value  string
+}
+
+func (r *taskOPTS) supported() bool {
+	return true
+}
+
+func (r *taskOPTS) requirePermission() bool {
+	return false
+}
+
+func (r *taskOPTS) parse(param string) error {
+	cmd := newCMD(param)
+	if len(cmd.fn) == 0 {
+		return errors.New("empty param")
+	}
+	r.option = cmd.fn
+	r.value = strings.ToUpper(strings.TrimSpace(cmd.param))
+	return nil
+}
+
+func (r *taskOPTS) execute(conn *conn) {
+	switch r.option {
+	case "HASH":
+		if len(r.value) == 0 {
+			conn.write(&reply{code: replyOkay, message: conn.hash})
+			return
+		}
+		if newHash(r.value) == nil {
+			conn.write(&reply{code: replyNotSupportedParameter, message: fmt.Sprintf("Unknown algorithm: %v", r.value)})
+			return
+		}
+		conn.hash = r.value
+		conn.write(&reply{code: replyOkay, message: conn.hash})
+	case "UTF8":
+		conn.write(&reply{code: replyOkay, message: "Always in UTF8 mode."})
+	default:
+		conn.write(&reply{code: replyInvalidParameter, message: fmt.Sprintf("Unknown option: %v", r.option)})
+	}
+}
+
+// taskRANG limits the next HASH or RETR to a byte range, and "RANG 1 0"
+// resets it.
+type taskRANG struct {
+	start int64
+	end   int64
+}
+
+func (r *taskRANG) supported() bool {
+	return true
+}
+
+func (r *taskRANG) requirePermission() bool {
+	return true
+}
+
+func (r *taskRANG) parse(param string) error {
+	v := strings.Fields(param)
+	if len(v) != 2 {
+		return errors.New("expected start and end")
+	}
+	start, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil || start < 0 {
+		return fmt.Errorf("invalid start: %v", v[0])
+	}
+	end, err := strconv.ParseInt(v[1], 10, 64)
+	if err != nil || end < 0 {
+		return fmt.Errorf("invalid end: %v", v[1])
+	}
+	if end < start && (start != 1 || end != 0) {
+		return errors.New("end before start")
+	}
+
+	r.start, r.end = start, end
+	return nil
+}
+
+func (r *taskRANG) execute(conn *conn) {
+	if r.start == 1 && r.end == 0 {
+		conn.rang = nil
+		conn.write(&reply{code: replyFileActionPending, message: "Byte range reset."})
+		return
+	}
+
+	conn.rang = &byteRange{start: r.start, end: r.end}
+	conn.write(&reply{code: replyFileActionPending, message: fmt.Sprintf("Restarting at %v. End byte range at %v.", r.start, r.end)})
+}
+
+// taskXHASH is the XCRC, XMD5, XSHA1 and XSHA256 commands, hashing the whole
+// file with a fixed algorithm.
+type taskXHASH struct {
+	algorithm string
+	path      string
+}
+
+func (r *taskXHASH) supported() bool {
+	return true
+}
+
+func (r *taskXHASH) requirePermission() bool {
+	return true
+}
+
+func (r *taskXHASH) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.path = param
+	return nil
+}
+
+func (r *taskXHASH) execute(conn *conn) {
+	sum, _, err := hashFile(conn, conn.buildPath(r.path), r.algorithm, nil)
+	if err != nil {
+		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+		return
+	}
+
+	s := hex.EncodeToString(sum)
+	if r.algorithm == "CRC32" {
+		s = strings.ToUpper(s)
+	}
+	conn.write(&reply{code: replyFileActionOkay, message: s})
+}
@@ -0,0 +1,79 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"log"
+	"net"
+)
+
+// TLSPolicy decides when a session must be protected by TLS. Clients from
+// the Exempt networks are never required to use TLS.
+type TLSPolicy struct {
+	RequireLogin bool
+	RequireData  bool
+	Exempt       []*net.IPNet
+}
+
+func (r *TLSPolicy) requireLogin(ip net.IP) bool {
+	return r != nil && r.RequireLogin == true && containsIP(r.Exempt, ip) == false
+}
+
+func (r *TLSPolicy) requireData(ip net.IP) bool {
+	return r != nil && r.RequireData == true && containsIP(r.Exempt, ip) == false
+}
+
+func (r *conn) tlsPolicy(user *User) *TLSPolicy {
+	if user != nil && user.TLSPolicy != nil {
+		return user.TLSPolicy
+	}
+
+	r.server.mutex.RLock()
+	defer r.server.mutex.RUnlock()
+
+	return r.server.TLSPolicy
+}
+
+func (r *conn) checkLoginProtection(user *User, code replyCode) bool {
+	if r.tlsConn != nil || r.tlsPolicy(user).requireLogin(r.remoteAddr.IP) == false {
+		return true
+	}
+
+	log.Printf("refused plaintext login: user=%v, addr=%v", r.requester, r.remoteAddr)
+	r.write(&reply{code: code, message: "Policy requires TLS on the control connection."})
+	return false
+}
+
+func (r *conn) checkDataProtection() bool {
+	if r.prot == "P" || r.tlsPolicy(r.account).requireData(r.remoteAddr.IP) == false {
+		return true
+	}
+
+	// The data connection of PASV or PORT is not used by the refused command.
+	if r.socket != nil {
+		if err := r.socket.Close(); err != nil {
+			log.Printf("failed to close socket: %v", err)
+		}
+		r.socket = nil
+	}
+	r.write(&reply{code: replyDeniedProt, message: "Data connection cannot be opened with this PROT setting."})
+	return false
+}
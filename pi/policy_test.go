@@ -0,0 +1,135 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file/memory"
+)
+
+func TestLoginProtection(t *testing.T) {
+	config, _ := newTLSConfig(t)
+	addr := startServer(t, &Server{
+		Users: []User{
+			{Name: "user", Password: "user"},
+			{Name: "legacy", Password: "legacy", TLSPolicy: &TLSPolicy{}},
+		},
+		Manager:   memory.New(),
+		Root:      "/",
+		TLSConfig: config,
+		TLSPolicy: &TLSPolicy{RequireLogin: true},
+	})
+
+	c := dial(t, addr)
+	c.expect(replyDeniedPolicy, "USER user")
+	c.expect(replyNotLoggedIn, "PASS user")
+	c.expect(replyNotLoggedIn, "CWD /")
+	c.expect(replyDeniedPolicy, "USER unknown")
+
+	c = dial(t, addr)
+	c.expect(replyUserNameOkay, "USER legacy")
+	c.expect(replyLoggedIn, "PASS legacy")
+
+	c = dial(t, addr)
+	c.secure(nil)
+	c.expect(replyUserNameOkay, "USER user")
+	c.expect(replyLoggedIn, "PASS user")
+}
+
+func TestLoginProtectionExempt(t *testing.T) {
+	exempt, err := ParseNetworks([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, &Server{
+		Users:     []User{{Name: "user", Password: "user"}},
+		Manager:   memory.New(),
+		Root:      "/",
+		TLSPolicy: &TLSPolicy{RequireLogin: true, RequireData: true, Exempt: exempt},
+	})
+
+	c := dial(t, addr)
+	c.expect(replyUserNameOkay, "USER user")
+	c.expect(replyLoggedIn, "PASS user")
+}
+
+func TestDataProtection(t *testing.T) {
+	config, _ := newTLSConfig(t)
+	fs := memory.New()
+	w, err := fs.Put(context.Background(), "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "data")
+	w.Close()
+	addr := startServer(t, &Server{
+		Users:     []User{{Name: "user", Password: "user"}},
+		Manager:   fs,
+		Root:      "/",
+		TLSConfig: config,
+		TLSPolicy: &TLSPolicy{RequireData: true},
+	})
+
+	c := dial(t, addr)
+	c.secure(nil)
+	c.expect(replyUserNameOkay, "USER user")
+	c.expect(replyLoggedIn, "PASS user")
+	c.expect(replyOkay, "PBSZ 0")
+
+	// The refused commands close their data connection.
+	for _, v := range []string{"RETR f", "LIST", "STOR g"} {
+		c.expect(replyOkay, "PROT C")
+		data := c.passive()
+		c.expect(replyDeniedProt, v)
+		data.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := data.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("data connection of %q was kept: %v", v, err)
+		}
+	}
+	if _, err := fs.Stat(context.Background(), "/g"); err == nil {
+		t.Fatal("refused upload created the file")
+	}
+
+	c.expect(replyOkay, "PROT P")
+	data := c.passive()
+	c.expect(replyFileStatusOkay, "RETR f")
+	if v := readProtected(t, c, data); v != "data" {
+		t.Fatalf("unexpected data: %q", v)
+	}
+	c.expect(replyCloseDTP, "")
+}
+
+func readProtected(t *testing.T, c *client, data net.Conn) string {
+	conn := tls.Client(data, c.tlsConfig(nil))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -39,26 +39,37 @@ const (
 	replyOkay           replyCode = 200
 	replySystemStatus   replyCode = 211
 	replyFileStatus     replyCode = 213
+	replyHelp           replyCode = 214
 	replyHello          replyCode = 220
 	replyCloseDTP       replyCode = 226
 	replyPASVOkay       replyCode = 227
 	replyEPSVOkay       replyCode = 229
 	replyLoggedIn       replyCode = 230
+	replyLoggedInSecure replyCode = 232
+	replyAuthOkay       replyCode = 234
 	replyFileActionOkay replyCode = 250
 	replyPathnameOkay   replyCode = 257
 
 	replyUserNameOkay      replyCode = 331
+	replyNeedAccount       replyCode = 332
 	replyFileActionPending replyCode = 350
 
-	replyFailedOpenDTP replyCode = 425
+	replyFailedOpenDTP   replyCode = 425
+	replyAbortedTransfer replyCode = 426
+	replyAbortedLocal    replyCode = 451
 
 	replyNotFoundCommand       replyCode = 500
 	replyInvalidParameter      replyCode = 501
 	replyNotSupportedCommand   replyCode = 502
+	replyBadSequence           replyCode = 503
 	replyNotSupportedParameter replyCode = 504
+	replyDeniedProt            replyCode = 521
 	replyNotSupportedNetwork   replyCode = 522
 	replyNotLoggedIn           replyCode = 530
+	replyDeniedPolicy          replyCode = 534
+	replyNotSupportedProt      replyCode = 536
 	replyUnavailableFile       replyCode = 550
+	replyExceededStorage       replyCode = 552
 )
 
 type reply struct {
@@ -22,36 +22,242 @@ package pi
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
+	"log"
 	"net"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/checksum"
 	"github.com/donamKim/ftp-server-go/file/driver"
+	"github.com/donamKim/ftp-server-go/file/privsep"
+	"github.com/donamKim/ftp-server-go/file/quota"
+	"github.com/donamKim/ftp-server-go/file/trash"
+	"github.com/donamKim/ftp-server-go/otp"
 )
 
 var ErrServerClosed = errors.New("ftp: Server closed")
 
+// ErrCredential is returned for a user with a Credential whose manager is not
+// the local file system, which the privsep helper could serve.
+var ErrCredential = errors.New("ftp: Credential needs the local file system")
+
 type Server struct {
-	User        User
+	Users []User
+
+	// Deprecated: User is the single account of the server before Users. It
+	// is kept for existing callers, and is looked up after Users when its
+	// Name is set.
+	User User
+
+	Access      *Access
 	Root        string
 	PIPort      int
 	PassivePort []int
+	TLSConfig   *tls.Config
+	TLSPolicy   *TLSPolicy
+
+	// Quotas limit directory trees for every user, in addition to the quota
+	// of the user.
+	Quotas []*quota.Tree
+
+	// Checksums caches the checksums computed during STOR and by the hash
+	// commands, by the storage of the user and the path.
+	Checksums *checksum.Cache
+
+	// Manager is shared by every session and must be safe for concurrent
+	// use. The local file system is used when it is nil, and a file.Manager
+	// is wrapped with file.Adapt.
+	Manager file.ManagerV2
+
+	// NewManager creates the file manager of a session once the user logged
+	// in. When it returns nil the session keeps Manager. The local file
+	// system of a user with a Credential is served by a privsep helper. A
+	// returned io.Closer is closed when the session ends.
+	NewManager func(user *User) (file.ManagerV2, error)
+
+	// Spawner starts the privsep helpers of the users with a Credential when
+	// it is set, so the server can drop its privileges after Listen.
+	Spawner *privsep.Spawner
+
+	mutex    sync.RWMutex
+	counters map[string]int64
+	sites    map[string]SiteHandler
+	trashes  trash.Schedule
 }
 
 type User struct {
 	Name     string
 	Password string
+	Access   *Access
+
+	// Certificates maps verified TLS client certificates to this user, see
+	// matchCertificate. A matching certificate logs the user in on USER
+	// unless RequireCertificate asks for the password as well.
+	Certificates       []string
+	RequireCertificate bool
+
+	// TLSPolicy overrides the server policy for this user when it is set.
+	TLSPolicy *TLSPolicy
+
+	// OTPSecret enables a TOTP second factor, given either appended to the
+	// password on PASS or on its own with ACCT.
+	OTPSecret string
+
+	// Credential runs the file operations of the session in a helper process
+	// with this system identity, see privsep.Start. Only the local file system
+	// can be served so, and the login fails with ErrCredential otherwise.
+	Credential *syscall.Credential
+
+	// Storage names the backend of the user for NewManager, and Root
+	// overrides the initial directory of the server for the user.
+	Storage string
+	Root    string
+
+	// Quota limits the files of the user, normally below Root. It is shared
+	// by the sessions of the user.
+	Quota *quota.Tree
+
+	// Trash moves removed files to the .trash directory below the initial
+	// directory of the user, where SITE RESTORE brings them back until
+	// TrashRetention passed. Zero keeps them forever.
+	Trash          bool
+	TrashRetention time.Duration
+
+	// Versions keeps this many previous contents of overwritten files in the
+	// .versions directory below the initial directory of the user, listed by
+	// SITE VERSIONS and read at "path;N". VersionsMaxAge drops older ones.
+	// Either one enables versioning, where zero is unlimited.
+	Versions       int
+	VersionsMaxAge time.Duration
+}
+
+// Reload replaces the accounts, the listener access rules, the TLS policy and
+// the quotas while the server is running. Sessions pick the new rules up on
+// their next login.
+func (r *Server) Reload(users []User, access *Access, policy *TLSPolicy, quotas []*quota.Tree) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Users = users
+	r.Access = access
+	r.TLSPolicy = policy
+	r.Quotas = quotas
+}
+
+// quotas returns the trees limiting the user.
+func (r *Server) quotas(user *User) []*quota.Tree {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	trees := make([]*quota.Tree, 0, len(r.Quotas)+1)
+	if user.Quota != nil {
+		trees = append(trees, user.Quota)
+	}
+	return append(trees, r.Quotas...)
+}
+
+func (r *Server) lookupUser(name string) *User {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, v := range r.Users {
+		if v.Name == name {
+			user := v
+			return &user
+		}
+	}
+	if len(r.User.Name) > 0 && r.User.Name == name {
+		user := r.User
+		return &user
+	}
+
+	return nil
+}
+
+// verifyOTP validates the code and refuses a counter that was already used
+// by the same user.
+func (r *Server) verifyOTP(user *User, code string) bool {
+	counter, ok := otp.Validate(user.OTPSecret, code, time.Now())
+	if ok == false {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.counters == nil {
+		r.counters = make(map[string]int64)
+	}
+	if last, ok := r.counters[user.Name]; ok == true && counter <= last {
+		return false
+	}
+	r.counters[user.Name] = counter
+
+	return true
+}
+
+func (r *Server) newManager(user *User) (file.ManagerV2, error) {
+	var manager file.ManagerV2
+	if r.NewManager != nil {
+		var err error
+		if manager, err = r.NewManager(user); err != nil {
+			return nil, err
+		}
+	}
+	if user.Credential == nil {
+		return manager, nil
+	}
+
+	// The local file system of a user with a credential is served by a
+	// privsep helper running as the user. Any other manager would run as the
+	// server, so the login is refused.
+	current := manager
+	if current == nil {
+		current = r.Manager
+	}
+	local, ok := current.(*driver.Driver)
+	if current == nil {
+		local, ok = &driver.Driver{}, true
+	}
+	if ok == false {
+		return nil, ErrCredential
+	}
+
+	start := privsep.Start
+	if r.Spawner != nil {
+		start = r.Spawner.Start
+	}
+	client, err := start(user.Credential, local)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (r *Server) permit(ip net.IP) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.Access.Permit(ip)
 }
 
 func (r *Server) ListenAndServe() error {
-	l, err := r.listen()
+	l, err := r.Listen()
 	if err != nil {
 		return err
 	}
-	return r.serve(l)
+	return r.Serve(l)
 }
 
-func (r *Server) listen() (*net.TCPListener, error) {
+// Listen binds the control port. It is separated from Serve so the caller
+// can drop its privileges after binding a privileged port.
+func (r *Server) Listen() (*net.TCPListener, error) {
 	laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort("", strconv.Itoa(r.PIPort)))
 	if err != nil {
 		return nil, err
@@ -59,7 +265,7 @@ func (r *Server) listen() (*net.TCPListener, error) {
 	return net.ListenTCP("tcp", laddr)
 }
 
-func (r *Server) serve(l *net.TCPListener) error {
+func (r *Server) Serve(l *net.TCPListener) error {
 	for {
 		v, err := l.AcceptTCP()
 		if err != nil {
@@ -68,19 +274,44 @@ func (r *Server) serve(l *net.TCPListener) error {
 			}
 			return err
 		}
+		if r.permit(v.RemoteAddr().(*net.TCPAddr).IP) == false {
+			log.Printf("denied connection: %v", v.RemoteAddr())
+			v.Close()
+			continue
+		}
 		c := r.newConn(v)
 		go c.serve()
 	}
 }
 
+// defaultManager is the manager of a session before the login, and of the
+// users without a manager of their own.
+func (r *Server) defaultManager() file.ManagerV2 {
+	if r.Manager != nil {
+		return r.Manager
+	}
+	return &driver.Driver{}
+}
+
 func (r *Server) newConn(c *net.TCPConn) *conn {
+	manager := r.defaultManager()
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &conn{
-		manager:     &driver.Driver{},
+		ctx:         ctx,
+		cancel:      cancel,
+		base:        manager,
+		manager:     manager,
+		netConn:     c,
+		tlsConfig:   r.TLSConfig,
 		reader:      bufio.NewReader(c),
 		writer:      bufio.NewWriter(c),
 		addr:        c.LocalAddr().(*net.TCPAddr),
-		user:        r.User,
+		remoteAddr:  c.RemoteAddr().(*net.TCPAddr),
+		server:      r,
 		directory:   r.Root,
 		passivePort: r.PassivePort,
+		hash:        defaultHash,
+		typeCode:    "A",
 	}
 }
@@ -0,0 +1,91 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/driver"
+	"github.com/donamKim/ftp-server-go/file/memory"
+	"github.com/donamKim/ftp-server-go/file/readonly"
+	"github.com/donamKim/ftp-server-go/otp"
+)
+
+func TestNewManagerCredential(t *testing.T) {
+	user := &User{Name: "user", Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	for _, v := range []file.ManagerV2{memory.New(), readonly.New(&driver.Driver{})} {
+		svr := &Server{Manager: v}
+		if _, err := svr.newManager(user); err != ErrCredential {
+			t.Fatalf("unexpected error: manager=%T, err=%v", v, err)
+		}
+
+		svr = &Server{NewManager: func(*User) (file.ManagerV2, error) { return v, nil }}
+		if _, err := svr.newManager(user); err != ErrCredential {
+			t.Fatalf("unexpected error: manager=%T, err=%v", v, err)
+		}
+	}
+
+	svr := &Server{Manager: memory.New()}
+	if manager, err := svr.newManager(&User{Name: "user"}); manager != nil || err != nil {
+		t.Fatalf("unexpected manager: %v, err=%v", manager, err)
+	}
+}
+
+func TestVerifyOTP(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	// The codes are made for the current period, which must not end during
+	// the test.
+	if otp.Period-time.Now().Unix()%otp.Period < 2 {
+		time.Sleep(2 * time.Second)
+	}
+	svr := &Server{}
+	alice := &User{Name: "alice", OTPSecret: secret}
+	bob := &User{Name: "bob", OTPSecret: secret}
+	code := func(periods int64) string {
+		v, err := otp.Generate(secret, otp.Counter(time.Now())+periods)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	if svr.verifyOTP(alice, code(-1)) == false {
+		t.Fatal("code of the previous period was refused")
+	}
+	if svr.verifyOTP(alice, code(0)) == false {
+		t.Fatal("current code was refused")
+	}
+	if svr.verifyOTP(alice, code(0)) == true {
+		t.Fatal("replayed code was accepted")
+	}
+	if svr.verifyOTP(alice, code(-1)) == true {
+		t.Fatal("code older than the last one was accepted")
+	}
+	if svr.verifyOTP(bob, code(0)) == false {
+		t.Fatal("code of another user was refused")
+	}
+	if svr.verifyOTP(alice, code(2)) == true {
+		t.Fatal("code beyond the skew was accepted")
+	}
+}
@@ -0,0 +1,529 @@
+/*
+ * FTP Server Go
+ *
+ * Copyright (C) 2019 Donam Kim. All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donamKim/ftp-server-go/file"
+)
+
+// siteCommands are the subcommands of SITE, parsed and executed like the
+// commands of the control connection.
+var siteCommands = map[string]task{
+	"CHMOD":    new(taskSiteCHMOD),
+	"CPFR":     new(taskSiteCPFR),
+	"CPTO":     new(taskSiteCPTO),
+	"HELP":     new(taskSiteHELP),
+	"QUOTA":    new(taskSiteQUOTA),
+	"RESTORE":  new(taskSiteRESTORE),
+	"SYMLINK":  new(taskSiteSYMLINK),
+	"UMASK":    new(taskSiteUMASK),
+	"VERSIONS": new(taskSiteVERSIONS),
+}
+
+// SiteHandler runs a SITE subcommand registered by HandleSite. It has to
+// reply exactly once.
+type SiteHandler func(req *SiteRequest)
+
+// SiteRequest is a SITE subcommand of a logged in session.
+type SiteRequest struct {
+	// Context is canceled when the session ends.
+	Context    context.Context
+	User       string
+	RemoteAddr net.Addr
+	// Directory is the current directory of the session.
+	Directory string
+	Param     string
+
+	conn *conn
+}
+
+// Reply writes a reply to the session, spread over several lines when the
+// message has line breaks.
+func (r *SiteRequest) Reply(code int, message string) {
+	message = strings.TrimRight(message, "\n")
+	if strings.Contains(message, "\n") == true {
+		r.conn.write(&reply{code: replyCode(code), message: message + "\n", multiline: true})
+		return
+	}
+	r.conn.write(&reply{code: replyCode(code), message: message})
+}
+
+// HandleSite registers a custom SITE subcommand, which cannot replace the
+// built-in ones.
+func (r *Server) HandleSite(name string, handler SiteHandler) error {
+	name = strings.ToUpper(name)
+	if len(name) == 0 || strings.ContainsAny(name, " \r\n") == true {
+		return fmt.Errorf("invalid SITE command name: %q", name)
+	}
+	if _, ok := siteCommands[name]; ok == true {
+		return fmt.Errorf("built-in SITE command: %v", name)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.sites == nil {
+		r.sites = make(map[string]SiteHandler)
+	}
+	r.sites[name] = handler
+	return nil
+}
+
+func (r *Server) siteHandler(name string) SiteHandler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.sites[name]
+}
+
+func (r *Server) siteNames() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.sites))
+	for k := range r.sites {
+		names = append(names, k)
+	}
+	return names
+}
+
+type taskSITE struct {
+	fn    string
+	param string
+	task  task
+}
+
+func (r *taskSITE) supported() bool {
+	return true
+}
+
+func (r *taskSITE) requirePermission() bool {
+	return true
+}
+
+func (r *taskSITE) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+
+	cmd := newCMD(param)
+	r.fn = cmd.fn
+	r.param = cmd.param
+	r.task = siteCommands[cmd.fn]
+	if r.task == nil {
+		return nil
+	}
+	return r.task.parse(cmd.param)
+}
+
+func (r *taskSITE) execute(conn *conn) {
+	if r.task == nil {
+		if handler := conn.server.siteHandler(r.fn); handler != nil {
+			handler(&SiteRequest{
+				Context:    conn.ctx,
+				User:       conn.account.Name,
+				RemoteAddr: conn.remoteAddr,
+				Directory:  conn.directory,
+				Param:      r.param,
+				conn:       conn,
+			})
+			return
+		}
+	}
+	if r.task == nil || r.task.supported() == false {
+		conn.write(&reply{code: replyNotSupportedParameter, message: fmt.Sprintf("Unknown SITE command: %v", r.fn)})
+		return
+	}
+	r.task.execute(conn)
+}
+
+// taskSiteQUOTA reports the usage of the quotas of the user, and rebuilds it
+// by scanning the trees with RESCAN.
+type taskSiteQUOTA struct {
+	rescan bool
+}
+
+func (r *taskSiteQUOTA) supported() bool {
+	return true
+}
+
+func (r *taskSiteQUOTA) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteQUOTA) parse(param string) error {
+	switch strings.ToUpper(param) {
+	case "":
+		r.rescan = false
+	case "RESCAN":
+		r.rescan = true
+	default:
+		return fmt.Errorf("unknown option: %v", param)
+	}
+	return nil
+}
+
+func (r *taskSiteQUOTA) execute(conn *conn) {
+	if len(conn.quotas) == 0 {
+		conn.write(&reply{code: replyOkay, message: "No quota."})
+		return
+	}
+
+	if r.rescan == true {
+		for _, v := range conn.quotas {
+			if err := v.Scan(conn.ctx, conn.base); err != nil {
+				conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+				return
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Quota usage:\n")
+	for _, v := range conn.quotas {
+		usage, limit := v.Usage(), v.Limit()
+		fmt.Fprintf(&buf, " %v: bytes=%v/%v, files=%v/%v\n", v.Path, usage.Bytes, formatLimit(limit.Bytes), usage.Files, formatLimit(limit.Files))
+	}
+	conn.write(&reply{code: replyOkay, message: buf.String(), multiline: true})
+}
+
+func formatLimit(n int64) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// taskSiteRESTORE restores the latest removed file of the path from the
+// trash, or lists the trash without a path.
+type taskSiteRESTORE struct {
+	path string
+}
+
+func (r *taskSiteRESTORE) supported() bool {
+	return true
+}
+
+func (r *taskSiteRESTORE) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteRESTORE) parse(param string) error {
+	r.path = param
+	return nil
+}
+
+func (r *taskSiteRESTORE) execute(conn *conn) {
+	if conn.trash == nil {
+		conn.write(&reply{code: replyNotSupportedParameter, message: "Trash is not enabled."})
+		return
+	}
+
+	if len(r.path) > 0 {
+		if err := conn.trash.Restore(conn.ctx, conn.buildPath(r.path)); err != nil {
+			conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+			return
+		}
+		conn.invalidateChecksums(conn.buildPath(r.path))
+		conn.write(&reply{code: replyFileActionOkay, message: "Requested file action okay, completed."})
+		return
+	}
+
+	entries, err := conn.trash.Entries(conn.ctx)
+	if err != nil {
+		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString("Trash:\n")
+	for _, v := range entries {
+		fmt.Fprintf(&buf, " %v %v\n", v.Deleted.UTC().Format(time.RFC3339), v.Path)
+	}
+	conn.write(&reply{code: replyOkay, message: buf.String(), multiline: true})
+}
+
+type taskSiteVERSIONS struct {
+	path string
+}
+
+func (r *taskSiteVERSIONS) supported() bool {
+	return true
+}
+
+func (r *taskSiteVERSIONS) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteVERSIONS) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.path = param
+	return nil
+}
+
+func (r *taskSiteVERSIONS) execute(conn *conn) {
+	if conn.versions == nil {
+		conn.write(&reply{code: replyNotSupportedParameter, message: "Versioning is not enabled."})
+		return
+	}
+
+	versions, err := conn.versions.Versions(conn.ctx, conn.buildPath(r.path))
+	if err != nil {
+		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Versions of %v:\n", r.path)
+	for _, v := range versions {
+		fmt.Fprintf(&buf, " %v;%v %v %v\n", r.path, v.Number, v.ModTime.UTC().Format(time.RFC3339), v.Size)
+	}
+	conn.write(&reply{code: replyOkay, message: buf.String(), multiline: true})
+}
+
+// taskSiteCPFR and taskSiteCPTO copy a file on the server like RNFR and RNTO
+// rename it.
+type taskSiteCPFR struct {
+	path string
+}
+
+func (r *taskSiteCPFR) supported() bool {
+	return true
+}
+
+func (r *taskSiteCPFR) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteCPFR) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.path = param
+	return nil
+}
+
+func (r *taskSiteCPFR) execute(conn *conn) {
+	conn.cpfr = conn.buildPath(r.path)
+	conn.write(&reply{code: replyFileActionPending, message: "Requested file action pending further information."})
+}
+
+type taskSiteCPTO struct {
+	path string
+}
+
+func (r *taskSiteCPTO) supported() bool {
+	return true
+}
+
+func (r *taskSiteCPTO) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteCPTO) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.path = param
+	return nil
+}
+
+func (r *taskSiteCPTO) execute(conn *conn) {
+	if len(conn.cpfr) == 0 {
+		conn.write(&reply{code: replyBadSequence, message: "Bad sequence of commands, send SITE CPFR first."})
+		return
+	}
+
+	from := conn.cpfr
+	conn.cpfr = ""
+	if err := file.Copy(conn.ctx, conn.manager, from, conn.buildPath(r.path)); err != nil {
+		conn.writeFileError(err)
+		return
+	}
+	conn.invalidateChecksums(conn.buildPath(r.path))
+	conn.write(&reply{code: replyFileActionOkay, message: "Requested file action okay, completed."})
+}
+
+// writeSiteError replies to a failed SITE action, telling a storage without
+// the capability apart.
+func writeSiteError(conn *conn, err error) {
+	if err == file.ErrNotSupported {
+		conn.write(&reply{code: replyNotSupportedParameter, message: "This storage does not support the command."})
+		return
+	}
+	conn.writeFileError(err)
+}
+
+type taskSiteCHMOD struct {
+	mode os.FileMode
+	path string
+}
+
+func (r *taskSiteCHMOD) supported() bool {
+	return true
+}
+
+func (r *taskSiteCHMOD) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteCHMOD) parse(param string) error {
+	v := strings.SplitN(param, " ", 2)
+	if len(v) != 2 || len(v[1]) == 0 {
+		return errors.New("expected mode and path")
+	}
+	mode, err := strconv.ParseUint(v[0], 8, 32)
+	if err != nil || mode > 07777 {
+		return fmt.Errorf("invalid mode: %v", v[0])
+	}
+
+	r.mode = os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		r.mode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		r.mode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		r.mode |= os.ModeSticky
+	}
+	r.path = v[1]
+	return nil
+}
+
+func (r *taskSiteCHMOD) execute(conn *conn) {
+	if err := file.Chmod(conn.ctx, conn.manager, conn.buildPath(r.path), r.mode); err != nil {
+		writeSiteError(conn, err)
+		return
+	}
+	conn.write(&reply{code: replyOkay, message: "SITE CHMOD command successful."})
+}
+
+// taskSiteUMASK shows or sets the umask of the files and the directories
+// created later in the session.
+type taskSiteUMASK struct {
+	umask os.FileMode
+	set   bool
+}
+
+func (r *taskSiteUMASK) supported() bool {
+	return true
+}
+
+func (r *taskSiteUMASK) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteUMASK) parse(param string) error {
+	if len(param) == 0 {
+		r.set = false
+		return nil
+	}
+	umask, err := strconv.ParseUint(param, 8, 32)
+	if err != nil || umask > 0777 {
+		return fmt.Errorf("invalid umask: %v", param)
+	}
+	r.umask, r.set = os.FileMode(umask), true
+	return nil
+}
+
+func (r *taskSiteUMASK) execute(conn *conn) {
+	if r.set == false {
+		if conn.umaskSet == false {
+			conn.write(&reply{code: replyOkay, message: "No UMASK set, the storage decides the modes."})
+			return
+		}
+		conn.write(&reply{code: replyOkay, message: fmt.Sprintf("Current UMASK is %03o.", uint32(conn.umask))})
+		return
+	}
+
+	conn.umask, conn.umaskSet = r.umask, true
+	conn.write(&reply{code: replyOkay, message: fmt.Sprintf("UMASK set to %03o.", uint32(r.umask))})
+}
+
+// taskSiteSYMLINK creates the link given second to the target given first.
+// A relative target is stored as given, relative to the link.
+type taskSiteSYMLINK struct {
+	target string
+	path   string
+}
+
+func (r *taskSiteSYMLINK) supported() bool {
+	return true
+}
+
+func (r *taskSiteSYMLINK) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteSYMLINK) parse(param string) error {
+	v := strings.Fields(param)
+	if len(v) != 2 {
+		return errors.New("expected target and link")
+	}
+	r.target, r.path = v[0], v[1]
+	return nil
+}
+
+func (r *taskSiteSYMLINK) execute(conn *conn) {
+	if err := file.Symlink(conn.ctx, conn.manager, r.target, conn.buildPath(r.path)); err != nil {
+		writeSiteError(conn, err)
+		return
+	}
+	conn.write(&reply{code: replyOkay, message: "SITE SYMLINK command successful."})
+}
+
+type taskSiteHELP struct{}
+
+func (r *taskSiteHELP) supported() bool {
+	return true
+}
+
+func (r *taskSiteHELP) requirePermission() bool {
+	return true
+}
+
+func (r *taskSiteHELP) parse(param string) error {
+	return nil
+}
+
+func (r *taskSiteHELP) execute(conn *conn) {
+	names := conn.server.siteNames()
+	for k, v := range siteCommands {
+		if v.supported() == true {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	conn.write(&reply{code: replyHelp, message: fmt.Sprintf("The following SITE commands are recognized:\n %v\n", strings.Join(names, " ")), multiline: true})
+}
@@ -24,10 +24,16 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"strconv"
 	"strings"
 
 	"github.com/donamKim/ftp-server-go/dtp"
+	"github.com/donamKim/ftp-server-go/file"
+	"github.com/donamKim/ftp-server-go/file/archive"
+	"github.com/donamKim/ftp-server-go/otp"
 )
 
 type task interface {
@@ -37,10 +43,12 @@ type task interface {
 	execute(conn *conn)
 }
 
-type taskAUTH struct{}
+type taskAUTH struct {
+	mechanism string
+}
 
 func (r *taskAUTH) supported() bool {
-	return false
+	return true
 }
 
 func (r *taskAUTH) requirePermission() bool {
@@ -48,10 +56,98 @@ func (r *taskAUTH) requirePermission() bool {
 }
 
 func (r *taskAUTH) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.mechanism = strings.ToUpper(param)
+	return nil
+}
+
+func (r *taskAUTH) execute(conn *conn) {
+	if conn.tlsConfig == nil {
+		conn.write(&reply{code: replyNotSupportedCommand, message: "TLS is not configured."})
+		return
+	}
+	if conn.tlsConn != nil {
+		conn.write(&reply{code: replyBadSequence, message: "Already using TLS."})
+		return
+	}
+	if r.mechanism != "TLS" && r.mechanism != "TLS-C" && r.mechanism != "SSL" {
+		conn.write(&reply{code: replyNotSupportedParameter, message: fmt.Sprintf("Unknown security mechanism: %v", r.mechanism)})
+		return
+	}
+
+	conn.write(&reply{code: replyAuthOkay, message: "AUTH command ok; starting TLS connection."})
+	if err := conn.secure(); err != nil {
+		log.Printf("failed to handshake TLS: %v", err)
+		conn.netConn.Close()
+	}
+}
+
+type taskPBSZ struct {
+	size string
+}
+
+func (r *taskPBSZ) supported() bool {
+	return true
+}
+
+func (r *taskPBSZ) requirePermission() bool {
+	return false
+}
+
+func (r *taskPBSZ) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.size = param
+	return nil
+}
+
+func (r *taskPBSZ) execute(conn *conn) {
+	if conn.tlsConn == nil {
+		conn.write(&reply{code: replyBadSequence, message: "PBSZ requires a secure control connection."})
+		return
+	}
+	conn.write(&reply{code: replyOkay, message: "PBSZ=0"})
+}
+
+type taskPROT struct {
+	level string
+}
+
+func (r *taskPROT) supported() bool {
+	return true
+}
+
+func (r *taskPROT) requirePermission() bool {
+	return false
+}
+
+func (r *taskPROT) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.level = strings.ToUpper(param)
 	return nil
 }
 
-func (r *taskAUTH) execute(conn *conn) {}
+func (r *taskPROT) execute(conn *conn) {
+	if conn.tlsConn == nil {
+		conn.write(&reply{code: replyBadSequence, message: "PROT requires a secure control connection."})
+		return
+	}
+
+	switch r.level {
+	case "C", "P":
+		conn.prot = r.level
+		conn.write(&reply{code: replyOkay, message: fmt.Sprintf("Protection level set to %v.", r.level)})
+	case "S", "E":
+		conn.write(&reply{code: replyNotSupportedProt, message: "Requested PROT level not supported by mechanism."})
+	default:
+		conn.write(&reply{code: replyNotSupportedParameter, message: fmt.Sprintf("Unknown protection level: %v", r.level)})
+	}
+}
 
 type taskUSER struct {
 	name string
@@ -75,6 +171,25 @@ func (r *taskUSER) parse(param string) error {
 
 func (r *taskUSER) execute(conn *conn) {
 	conn.requester = r.name
+	conn.certified = false
+	conn.pending = nil
+
+	user := conn.server.lookupUser(r.name)
+	if conn.checkLoginProtection(user, replyDeniedPolicy) == false {
+		return
+	}
+	if user != nil && matchCertificate(conn.peerCertificate(), user.Certificates) == true {
+		conn.certified = true
+		if user.RequireCertificate == false && len(user.OTPSecret) == 0 {
+			if conn.login(user) == false {
+				conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+				return
+			}
+			conn.write(&reply{code: replyLoggedInSecure, message: "User logged in, authorized by security data exchange."})
+			return
+		}
+	}
+
 	conn.write(&reply{code: replyUserNameOkay, message: "User name okay, need password."})
 }
 
@@ -99,12 +214,101 @@ func (r *taskPASS) parse(param string) error {
 }
 
 func (r *taskPASS) execute(conn *conn) {
-	if conn.requester == conn.user.Name && r.password == conn.user.Password {
-		conn.loggedIn = true
-		conn.write(&reply{code: replyLoggedIn, message: "User logged in, proceed."})
-	} else {
+	user := conn.server.lookupUser(conn.requester)
+	if conn.checkLoginProtection(user, replyNotLoggedIn) == false {
+		return
+	}
+	if user == nil {
+		conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+		return
+	}
+	password, code := r.password, ""
+	if len(user.OTPSecret) > 0 {
+		password, code = splitOTP(r.password, user.Password)
+	}
+	if password != user.Password {
+		conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+		return
+	}
+	if user.RequireCertificate == true && conn.certified == false {
+		log.Printf("missing client certificate: user=%v", user.Name)
 		conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+		return
+	}
+	if len(user.OTPSecret) > 0 {
+		if len(code) == 0 {
+			conn.pending = user
+			conn.write(&reply{code: replyNeedAccount, message: "Need one-time password with ACCT."})
+			return
+		}
+		if conn.server.verifyOTP(user, code) == false {
+			log.Printf("invalid one-time password: user=%v", user.Name)
+			conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+			return
+		}
 	}
+	if conn.login(user) == false {
+		conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+		return
+	}
+
+	conn.write(&reply{code: replyLoggedIn, message: "User logged in, proceed."})
+}
+
+// splitOTP separates a one-time password appended to the password, with or
+// without a "+" in between.
+func splitOTP(param string, password string) (string, string) {
+	if param == password || len(param) <= otp.Digits {
+		return param, ""
+	}
+
+	prefix, code := param[:len(param)-otp.Digits], param[len(param)-otp.Digits:]
+	if prefix != password && strings.TrimSuffix(prefix, "+") == password {
+		prefix = password
+	}
+
+	return prefix, code
+}
+
+type taskACCT struct {
+	code string
+}
+
+func (r *taskACCT) supported() bool {
+	return true
+}
+
+func (r *taskACCT) requirePermission() bool {
+	return false
+}
+
+func (r *taskACCT) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.code = param
+	return nil
+}
+
+func (r *taskACCT) execute(conn *conn) {
+	user := conn.pending
+	if user == nil {
+		conn.write(&reply{code: replyBadSequence, message: "Login with USER and PASS first."})
+		return
+	}
+	conn.pending = nil
+
+	if conn.server.verifyOTP(user, r.code) == false {
+		log.Printf("invalid one-time password: user=%v", user.Name)
+		conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+		return
+	}
+	if conn.login(user) == false {
+		conn.write(&reply{code: replyNotLoggedIn, message: "Not logged in."})
+		return
+	}
+
+	conn.write(&reply{code: replyLoggedIn, message: "User logged in, proceed."})
 }
 
 type taskFEAT struct{}
@@ -122,7 +326,20 @@ func (r *taskFEAT) parse(param string) error {
 }
 
 func (r *taskFEAT) execute(conn *conn) {
-	conn.write(&reply{code: replySystemStatus, message: "Extensions supported:\n UTF8\n", multiline: true})
+	message := "Extensions supported:\n UTF8\n"
+	if conn.tlsConfig != nil {
+		message += " AUTH TLS\n PBSZ\n PROT\n"
+	}
+	message += " REST STREAM\n RANG STREAM\n"
+	algorithms := make([]string, 0, len(hashAlgorithms))
+	for _, v := range hashAlgorithms {
+		if v == conn.hash {
+			v += "*"
+		}
+		algorithms = append(algorithms, v)
+	}
+	message += fmt.Sprintf(" HASH %v\n XCRC\n XMD5\n XSHA1\n XSHA256\n", strings.Join(algorithms, ";"))
+	conn.write(&reply{code: replySystemStatus, message: message, multiline: true})
 }
 
 type taskPWD struct{}
@@ -172,8 +389,10 @@ func (r *taskTYPE) parse(param string) error {
 func (r *taskTYPE) execute(conn *conn) {
 	switch r.code {
 	case "A":
+		conn.typeCode = r.code
 		conn.write(&reply{code: replyOkay, message: "Representation type set to ASCII."})
 	case "I":
+		conn.typeCode = r.code
 		conn.write(&reply{code: replyOkay, message: "Representation type set to Image."})
 	default:
 		conn.write(&reply{code: replyNotSupportedCommand, message: "Command not implemented for that parameter."})
@@ -340,7 +559,10 @@ func (r *taskLIST) parse(param string) error {
 }
 
 func (r *taskLIST) execute(conn *conn) {
-	info, err := conn.manager.Stat(conn.buildPath(r.path))
+	if conn.checkDataProtection() == false {
+		return
+	}
+	info, err := conn.manager.Stat(conn.ctx, conn.buildPath(r.path))
 	if err != nil {
 		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 		return
@@ -348,7 +570,7 @@ func (r *taskLIST) execute(conn *conn) {
 
 	var buf bytes.Buffer
 	if info.IsDir() == true {
-		list, err := conn.manager.List(conn.buildPath(r.path))
+		list, err := conn.manager.List(conn.ctx, conn.buildPath(r.path))
 		if err != nil {
 			conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 			return
@@ -361,7 +583,10 @@ func (r *taskLIST) execute(conn *conn) {
 	}
 
 	conn.write(&reply{code: replyFileStatusOkay, message: "File status okay; about to open data connection."})
-	conn.writeSocket(bytes.NewReader(buf.Bytes()))
+	if err := conn.writeSocket(bytes.NewReader(buf.Bytes()), &transfer{name: "LIST " + r.path, size: int64(buf.Len())}); err != nil {
+		conn.writeTransferError(err)
+		return
+	}
 	conn.write(&reply{code: replyCloseDTP, message: "Closing data connection."})
 }
 
@@ -405,17 +630,67 @@ func (r *taskRETR) parse(param string) error {
 }
 
 func (r *taskRETR) execute(conn *conn) {
-	f, err := conn.manager.Get(conn.buildPath(r.path))
+	if conn.checkDataProtection() == false {
+		return
+	}
+	offset := conn.rest
+	conn.rest = 0
+	rang := conn.rang
+	conn.rang = nil
+	if rang != nil {
+		offset = rang.start
+	}
+
+	path := conn.buildPath(r.path)
+	f, err := file.GetAt(conn.ctx, conn.manager, path, offset)
+	if os.IsNotExist(err) == true {
+		if reader, ok := openDirectoryArchive(conn, path, offset); ok == true {
+			f, err = reader, nil
+		}
+	}
 	if err != nil {
 		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 		return
 	}
+	defer f.Close()
 
+	var reader io.Reader = f
+	t := &transfer{name: "RETR " + r.path, size: -1}
+	if rang != nil {
+		reader = io.LimitReader(f, rang.end-rang.start+1)
+		t.size = rang.end - rang.start + 1
+	}
 	conn.write(&reply{code: replyFileStatusOkay, message: "File status okay; about to open data connection."})
-	conn.writeSocket(f)
+	if err := conn.writeSocket(reader, t); err != nil {
+		conn.writeTransferError(err)
+		return
+	}
 	conn.write(&reply{code: replyCloseDTP, message: "Closing data connection."})
 }
 
+// openDirectoryArchive streams an archive of the directory when a missing
+// file is named like "dir.tar.gz", building it while it is sent.
+func openDirectoryArchive(conn *conn, path string, offset int64) (io.ReadCloser, bool) {
+	dir, ok := archive.TrimExtension(path)
+	if ok == false || offset > 0 {
+		return nil, false
+	}
+	if info, err := conn.manager.Stat(conn.ctx, dir); err != nil || info.IsDir() == false {
+		return nil, false
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := archive.Write(conn.ctx, conn.manager, dir, path, writer)
+		if err != nil && err != io.ErrClosedPipe {
+			log.Printf("failed to archive directory: path=%v, err=%v", dir, err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return reader, true
+}
+
 type taskSTOR struct {
 	path string
 }
@@ -434,14 +709,148 @@ func (r *taskSTOR) parse(param string) error {
 }
 
 func (r *taskSTOR) execute(conn *conn) {
+	if conn.checkDataProtection() == false {
+		return
+	}
+	offset := conn.rest
+	conn.rest = 0
+
+	path := conn.buildPath(r.path)
+	created := conn.creating(path)
+	var w io.WriteCloser
+	var err error
+	if offset > 0 {
+		w, err = file.PutAt(conn.ctx, conn.manager, path, offset)
+	} else {
+		w, err = conn.manager.Put(conn.ctx, path)
+	}
+	if err != nil {
+		conn.writeFileError(err)
+		return
+	}
+
+	// Only a whole upload is hashed on the way, the others change the file
+	// in place.
+	var hashes *hashWriter
+	if offset == 0 && conn.server.Checksums != nil {
+		hashes = newHashWriter(w)
+		w = hashes
+	} else {
+		conn.invalidateChecksums(path)
+	}
+
 	conn.write(&reply{code: replyFileStatusOkay, message: "File status okay; about to open data connection."})
-	if err := conn.manager.Put(conn.buildPath(r.path), conn.socket); err != nil {
-		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+	if err := conn.readSocket(w, &transfer{name: "STOR " + r.path, size: -1}); err != nil {
+		conn.writeFileError(err)
+		return
+	}
+	if created == true {
+		conn.applyUmask(path, 0666)
+	}
+	if hashes != nil {
+		if info, err := conn.manager.Stat(conn.ctx, path); err == nil {
+			conn.storeChecksums(path, info, hashes.sums())
+		}
+	}
+	conn.write(&reply{code: replyCloseDTP, message: "Closing data connection."})
+}
+
+type taskAPPE struct {
+	path string
+}
+
+func (r *taskAPPE) supported() bool {
+	return true
+}
+
+func (r *taskAPPE) requirePermission() bool {
+	return true
+}
+
+func (r *taskAPPE) parse(param string) error {
+	r.path = param
+	return nil
+}
+
+func (r *taskAPPE) execute(conn *conn) {
+	if conn.checkDataProtection() == false {
 		return
 	}
+	path := conn.buildPath(r.path)
+	created := conn.creating(path)
+	w, err := file.Append(conn.ctx, conn.manager, path)
+	if err != nil {
+		conn.writeFileError(err)
+		return
+	}
+	conn.invalidateChecksums(path)
+
+	conn.write(&reply{code: replyFileStatusOkay, message: "File status okay; about to open data connection."})
+	if err := conn.readSocket(w, &transfer{name: "APPE " + r.path, size: -1}); err != nil {
+		conn.writeFileError(err)
+		return
+	}
+	if created == true {
+		conn.applyUmask(path, 0666)
+	}
 	conn.write(&reply{code: replyCloseDTP, message: "Closing data connection."})
 }
 
+type taskREST struct {
+	offset int64
+}
+
+func (r *taskREST) supported() bool {
+	return true
+}
+
+func (r *taskREST) requirePermission() bool {
+	return true
+}
+
+func (r *taskREST) parse(param string) (err error) {
+	r.offset, err = strconv.ParseInt(param, 10, 64)
+	if err == nil && r.offset < 0 {
+		err = errors.New("negative offset")
+	}
+	return err
+}
+
+func (r *taskREST) execute(conn *conn) {
+	conn.rest = r.offset
+	conn.write(&reply{code: replyFileActionPending, message: fmt.Sprintf("Restarting at %v. Send STOR or RETR.", r.offset)})
+}
+
+type taskMKD struct {
+	path string
+}
+
+func (r *taskMKD) supported() bool {
+	return true
+}
+
+func (r *taskMKD) requirePermission() bool {
+	return true
+}
+
+func (r *taskMKD) parse(param string) error {
+	if len(param) == 0 {
+		return errors.New("empty param")
+	}
+	r.path = param
+	return nil
+}
+
+func (r *taskMKD) execute(conn *conn) {
+	path := conn.buildPath(r.path)
+	if err := file.Mkdir(conn.ctx, conn.manager, path); err != nil {
+		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+		return
+	}
+	conn.applyUmask(path, 0777)
+	conn.write(&reply{code: replyPathnameOkay, message: fmt.Sprintf("\"%v\" created.", path)})
+}
+
 type taskDELE struct {
 	path string
 }
@@ -460,7 +869,7 @@ func (r *taskDELE) parse(param string) error {
 }
 
 func (r *taskDELE) execute(conn *conn) {
-	info, err := conn.manager.Stat(conn.buildPath(r.path))
+	info, err := conn.manager.Stat(conn.ctx, conn.buildPath(r.path))
 	if err != nil {
 		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 		return
@@ -470,10 +879,11 @@ func (r *taskDELE) execute(conn *conn) {
 		return
 	}
 
-	if err := conn.manager.Remove(conn.buildPath(r.path)); err != nil {
+	if err := conn.manager.Remove(conn.ctx, conn.buildPath(r.path)); err != nil {
 		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 		return
 	}
+	conn.invalidateChecksums(conn.buildPath(r.path))
 	conn.write(&reply{code: replyFileActionOkay, message: "Requested file action okay, completed."})
 }
 
@@ -495,7 +905,7 @@ func (r *taskRMD) parse(param string) error {
 }
 
 func (r *taskRMD) execute(conn *conn) {
-	info, err := conn.manager.Stat(conn.buildPath(r.path))
+	info, err := conn.manager.Stat(conn.ctx, conn.buildPath(r.path))
 	if err != nil {
 		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 		return
@@ -505,10 +915,11 @@ func (r *taskRMD) execute(conn *conn) {
 		return
 	}
 
-	if err := conn.manager.Remove(conn.buildPath(r.path)); err != nil {
+	if err := conn.manager.Remove(conn.ctx, conn.buildPath(r.path)); err != nil {
 		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 		return
 	}
+	conn.invalidateChecksumDir(conn.buildPath(r.path))
 	conn.write(&reply{code: replyFileActionOkay, message: "Requested file action okay, completed."})
 }
 
@@ -552,10 +963,15 @@ func (r *taskRNTO) parse(param string) error {
 }
 
 func (r *taskRNTO) execute(conn *conn) {
-	if err := conn.manager.Rename(conn.rnfr, conn.buildPath(r.path)); err != nil {
-		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+	if err := conn.manager.Rename(conn.ctx, conn.rnfr, conn.buildPath(r.path)); err != nil {
+		conn.writeFileError(err)
 		return
 	}
+	conn.invalidateChecksums(conn.rnfr, conn.buildPath(r.path))
+	if info, err := conn.manager.Stat(conn.ctx, conn.buildPath(r.path)); err == nil && info.IsDir() == true {
+		conn.invalidateChecksumDir(conn.rnfr)
+		conn.invalidateChecksumDir(conn.buildPath(r.path))
+	}
 	conn.rnfr = ""
 	conn.write(&reply{code: replyFileActionOkay, message: "Requested file action okay, completed."})
 }
@@ -578,10 +994,61 @@ func (r *taskSIZE) parse(param string) error {
 }
 
 func (r *taskSIZE) execute(conn *conn) {
-	info, err := conn.manager.Stat(conn.buildPath(r.path))
+	info, err := conn.manager.Stat(conn.ctx, conn.buildPath(r.path))
 	if err != nil {
 		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
 		return
 	}
 	conn.write(&reply{code: replyFileStatus, message: strconv.Itoa(int(info.Size()))})
 }
+
+type taskSTAT struct {
+	path string
+}
+
+func (r *taskSTAT) supported() bool {
+	return true
+}
+
+// requirePermission is false for the status of the session, which is
+// available before the login. The listing of a path checks the login itself.
+func (r *taskSTAT) requirePermission() bool {
+	return false
+}
+
+func (r *taskSTAT) parse(param string) error {
+	r.path = param
+	return nil
+}
+
+func (r *taskSTAT) execute(conn *conn) {
+	if len(r.path) == 0 {
+		conn.write(&reply{code: replySystemStatus, message: conn.status(), multiline: true})
+		return
+	}
+	if conn.loggedIn == false {
+		conn.write(&reply{code: replyNotLoggedIn, message: "Not permission to this command."})
+		return
+	}
+
+	path := conn.buildPath(r.path)
+	info, err := conn.manager.Stat(conn.ctx, path)
+	if err != nil {
+		conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+		return
+	}
+	list := []*file.Info{info}
+	if info.IsDir() == true {
+		if list, err = conn.manager.List(conn.ctx, path); err != nil {
+			conn.write(&reply{code: replyUnavailableFile, message: fmt.Sprintf("File unavailable: %v", err)})
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Status of %v:\n", r.path)
+	for _, v := range list {
+		fmt.Fprintf(&buf, " %s\n", bytes.TrimRight(v.Encode(), "\r\n"))
+	}
+	conn.write(&reply{code: replyFileStatus, message: buf.String(), multiline: true})
+}